@@ -0,0 +1,149 @@
+package raucgithub
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// AnyChannel subscribes to updates from all channels, including channels which are not known to the manager
+const AnyChannel = "*"
+
+var ErrUnknownChannel = errors.New("unknown update channel")
+
+// DefaultChannels are the known channels, ordered from the most to the least stable
+var DefaultChannels = []string{repository.StableChannel, "beta", "nightly", "internal"}
+
+// SubscribeToChannel only offers updates published on the channel or on a more stable channel, i.e. devices
+// subscribed to beta also receive stable releases
+func SubscribeToChannel(channel string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.channel = strings.ToLower(channel)
+		return u
+	}
+}
+
+// WithChannels replaces the known channels, ordered from the most to the least stable
+func WithChannels(channels ...string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.channels = nil
+		for _, channel := range channels {
+			u.channels = append(u.channels, strings.ToLower(channel))
+		}
+		return u
+	}
+}
+
+// PersistChannelIn stores the channel selected via SetChannel in file, so it survives restarts. A channel
+// stored in the file takes precedence over the configured channel.
+func PersistChannelIn(file string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.channelFile = file
+		return u
+	}
+}
+
+// Deprecated: Use SubscribeToChannel instead. UpdateToPrerelease subscribes to all channels.
+func UpdateToPrerelease(u *UpdateManager) *UpdateManager {
+	u.channel = AnyChannel
+	return u
+}
+
+func (u *UpdateManager) loadChannel() error {
+	if u.channelFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(u.channelFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read update channel from %s: %w", u.channelFile, err)
+	}
+	if channel := strings.TrimSpace(string(data)); channel != "" {
+		u.channel = strings.ToLower(channel)
+	}
+	return nil
+}
+
+func (u *UpdateManager) knowsChannel(channel string) bool {
+	if channel == AnyChannel {
+		return true
+	}
+	for _, c := range u.channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Channel returns the channel the manager is subscribed to
+func (u *UpdateManager) Channel() string {
+	u.channelLock.RLock()
+	defer u.channelLock.RUnlock()
+	return u.channel
+}
+
+// Channels returns the known channels, ordered from the most to the least stable
+func (u *UpdateManager) Channels() []string {
+	return append([]string{}, u.channels...)
+}
+
+// SetChannel subscribes to another channel. An update which has been found on the previous channel is
+// forgotten.
+func (u *UpdateManager) SetChannel(channel string) error {
+	channel = strings.ToLower(strings.TrimSpace(channel))
+	if !u.knowsChannel(channel) {
+		return fmt.Errorf("%w %q, known channels are %s", ErrUnknownChannel, channel, strings.Join(u.channels, ", "))
+	}
+	u.channelLock.Lock()
+	defer u.channelLock.Unlock()
+	if u.channelFile != "" {
+		if err := os.MkdirAll(filepath.Dir(u.channelFile), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for update channel: %w", err)
+		}
+		if err := os.WriteFile(u.channelFile, []byte(channel+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to store update channel: %w", err)
+		}
+	}
+	if channel != u.channel {
+		u.logger.WithFields(logrus.Fields{
+			"previousChannel": u.channel,
+			"channel":         channel,
+		}).Info("switched update channel")
+		u.setNextUpdate(nil, nil)
+	}
+	u.channel = channel
+	return nil
+}
+
+// ChannelOf returns the channel of the update like repository.ChannelOf. Pre-release names which are no known
+// channel, i.e. rc or alpha, are treated as prereleases on repository.PrereleaseChannel.
+func (u *UpdateManager) ChannelOf(update *repository.Update) string {
+	channel := repository.ChannelOf(update)
+	if update.Channel == "" && !u.knowsChannel(channel) {
+		return repository.PrereleaseChannel
+	}
+	return channel
+}
+
+// acceptsChannel reports whether a device subscribed to subscribed receives updates published on channel
+func (u *UpdateManager) acceptsChannel(subscribed, channel string) bool {
+	if subscribed == AnyChannel || subscribed == channel {
+		return true
+	}
+	for _, c := range u.channels {
+		if c == channel {
+			return true
+		}
+		if c == subscribed {
+			return false
+		}
+	}
+	return false
+}
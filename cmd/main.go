@@ -2,20 +2,44 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
 	"github.com/dereulenspiegel/raucgithub"
-	"github.com/dereulenspiegel/raucgithub/repository/github"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/dereulenspiegel/raucgithub/repository/cache"
+	"github.com/dereulenspiegel/raucgithub/repository/checksum"
+	"github.com/dereulenspiegel/raucgithub/repository/tuf"
 	"github.com/dereulenspiegel/raucgithub/server"
 )
 
 func setDefaults() {
 	viper.SetDefault("dbus.enabled", true)
+	viper.SetDefault("repo.type", "github")
+	viper.SetDefault("cache.dir", cache.DefaultDir)
+	viper.SetDefault("tuf.trustedRoot", tuf.DefaultTrustedRoot)
+	viper.SetDefault("tuf.stateDir", tuf.DefaultStateDir)
+}
+
+// createRepository creates the repository selected via repo.type, configured with repo.<type>
+func createRepository() (repository.Repository, error) {
+	repoType := viper.GetString("repo.type")
+	newRepository, exists := repository.Builder(repoType)
+	if !exists {
+		return nil, fmt.Errorf("unknown repository type %s, available types are %s", repoType,
+			strings.Join(repository.Types(), ", "))
+	}
+	conf := viper.Sub("repo." + repoType)
+	if conf == nil {
+		conf = viper.New()
+	}
+	return newRepository(conf)
 }
 
 var (
@@ -60,18 +84,41 @@ func main() {
 	}
 
 	go func() {
-		githubConfig := viper.Sub("repo.github")
-		githubRepo, err := github.New(githubConfig)
+		repo, err := createRepository()
 		if err != nil {
 			logger.WithError(err).Fatal("failed to create repository")
 		}
+		// Hashes of TUF metadata take precedence over the ones of checksum files
+		repo = checksum.New(repo)
+		if viper.GetBool("cache.enabled") {
+			// Cached updates are verified against the current TUF metadata, so the cache can't be used to
+			// serve stale updates
+			repo, err = cache.New(repo, viper.GetString("cache.dir"))
+			if err != nil {
+				logger.WithError(err).Fatal("failed to create repository cache")
+			}
+		}
+		if viper.GetBool("tuf.enabled") {
+			repo, err = tuf.New(repo, tuf.Config{
+				MetadataURL: viper.GetString("tuf.metadataURL"),
+				TrustedRoot: viper.GetString("tuf.trustedRoot"),
+				StateDir:    viper.GetString("tuf.stateDir"),
+			})
+			if err != nil {
+				logger.WithError(err).Fatal("failed to set up TUF verification")
+			}
+		}
 
 		updateManagerConfig := viper.Sub("manager")
-		manager, err := raucgithub.NewUpdateManagerFromConfig(githubRepo, updateManagerConfig)
+		manager, err := raucgithub.NewUpdateManagerFromConfig(repo, updateManagerConfig)
 		if err != nil {
 			logger.WithError(err).Fatal("failed to create update manager")
 		}
 
+		if err := manager.WatchRepository(ctx); err != nil {
+			logger.WithError(err).Error("failed to watch repository for changes")
+		}
+
 		serverBuilders := server.Builders()
 
 		for _, builder := range serverBuilders {
@@ -0,0 +1,15 @@
+package main
+
+// The built in repository types register themselves, additional types can be added in separate files which
+// are enabled via build tags.
+import (
+	_ "github.com/dereulenspiegel/raucgithub/repository/gitea"
+	_ "github.com/dereulenspiegel/raucgithub/repository/github"
+	_ "github.com/dereulenspiegel/raucgithub/repository/gitlab"
+	_ "github.com/dereulenspiegel/raucgithub/repository/hawkbit"
+	_ "github.com/dereulenspiegel/raucgithub/repository/local"
+	_ "github.com/dereulenspiegel/raucgithub/repository/manifest"
+	_ "github.com/dereulenspiegel/raucgithub/repository/multi"
+	_ "github.com/dereulenspiegel/raucgithub/repository/oci"
+	_ "github.com/dereulenspiegel/raucgithub/repository/s3"
+)
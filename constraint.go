@@ -0,0 +1,351 @@
+package raucgithub
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrInvalidConstraint = errors.New("invalid version constraint")
+
+type comparator struct {
+	operator string
+	version  semver.Version
+}
+
+func (c comparator) check(v *semver.Version) bool {
+	switch c.operator {
+	case "=":
+		return v.Equal(c.version)
+	case "!=":
+		return !v.Equal(c.version)
+	case ">":
+		return c.version.LessThan(*v)
+	case ">=":
+		return !v.LessThan(c.version)
+	case "<":
+		bound := c.version
+		if bound.PreRelease == "" {
+			// <3.0.0 is meant to exclude 3.0.0-beta.1 as well, 0 is the lowest possible pre-release
+			bound.PreRelease = "0"
+		}
+		return v.LessThan(bound)
+	case "<=":
+		return !c.version.LessThan(*v)
+	}
+	return false
+}
+
+// VersionConstraint restricts the versions which are offered as update. Constraints consist of comparators
+// separated by whitespace or commas, which all need to match, i.e. ">=2.1.0 <3.0.0". Alternatives are
+// separated by ||. Comparators are =, !=, >, >=, <, <=, ~ (patch updates, ~2.4 means >=2.4.0 <2.5.0) and
+// ^ (updates which don't change the left-most non-zero part). Versions may be partial or contain wildcards,
+// so 2.x or 2 means >=2.0.0 <3.0.0. Hyphen ranges like 2.1 - 2.4 include both ends.
+type VersionConstraint struct {
+	raw    string
+	ranges [][]comparator
+}
+
+// ParseVersionConstraint parses constraints like ">=2.1.0 <3.0.0", "~2.4" or "2.4.3"
+func ParseVersionConstraint(constraint string) (*VersionConstraint, error) {
+	c := &VersionConstraint{raw: strings.TrimSpace(constraint)}
+	if c.raw == "" {
+		return nil, fmt.Errorf("%w: constraint is empty", ErrInvalidConstraint)
+	}
+	for _, alternative := range strings.Split(c.raw, "||") {
+		comparators, err := parseRange(alternative)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %s", ErrInvalidConstraint, constraint, err)
+		}
+		c.ranges = append(c.ranges, comparators)
+	}
+	return c, nil
+}
+
+// ExactVersion creates a constraint which only accepts the given version, which pins the device to it
+func ExactVersion(version *semver.Version) *VersionConstraint {
+	return &VersionConstraint{
+		raw:    "=" + version.String(),
+		ranges: [][]comparator{{{operator: "=", version: *version}}},
+	}
+}
+
+// Check reports whether the version satisfies the constraint
+func (c *VersionConstraint) Check(v *semver.Version) bool {
+	for _, comparators := range c.ranges {
+		matches := true
+		for _, comp := range comparators {
+			if !comp.check(v) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *VersionConstraint) String() string {
+	return c.raw
+}
+
+const comparatorOperators = "=!<>~^"
+
+func parseRange(alternative string) (comparators []comparator, err error) {
+	tokens := strings.Fields(strings.ReplaceAll(alternative, ",", " "))
+	if len(tokens) == 0 {
+		return nil, errors.New("empty alternative")
+	}
+	// Operators may be separated from their version by whitespace, i.e. ">= 2.1.0"
+	var joined []string
+	for i := 0; i < len(tokens); i++ {
+		if strings.Trim(tokens[i], comparatorOperators) == "" && tokens[i] != "" && i+1 < len(tokens) {
+			joined = append(joined, tokens[i]+tokens[i+1])
+			i++
+			continue
+		}
+		joined = append(joined, tokens[i])
+	}
+	tokens = joined
+
+	if len(tokens) == 3 && tokens[1] == "-" {
+		lower, err := expandComparator(">=" + tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		upper, err := expandComparator("<=" + tokens[2])
+		if err != nil {
+			return nil, err
+		}
+		return append(lower, upper...), nil
+	}
+	for _, token := range tokens {
+		expanded, err := expandComparator(token)
+		if err != nil {
+			return nil, err
+		}
+		comparators = append(comparators, expanded...)
+	}
+	return comparators, nil
+}
+
+// expandComparator converts a single comparator into comparators on complete versions
+func expandComparator(token string) ([]comparator, error) {
+	version := strings.TrimLeft(token, comparatorOperators)
+	operator := token[:len(token)-len(version)]
+	if operator == "" || operator == "==" {
+		operator = "="
+	}
+	switch operator {
+	case "=", "!=", ">", ">=", "<", "<=", "~", "^":
+	default:
+		return nil, fmt.Errorf("unknown operator %q", operator)
+	}
+
+	v, parts, err := parsePartialVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	if parts == 0 {
+		// Wildcards match every version
+		return nil, nil
+	}
+	if parts == 3 {
+		switch operator {
+		case "~":
+			return []comparator{{">=", v}, {"<", semver.Version{Major: v.Major, Minor: v.Minor + 1}}}, nil
+		case "^":
+			return []comparator{{">=", v}, {"<", caretBound(v, parts)}}, nil
+		}
+		return []comparator{{operator, v}}, nil
+	}
+
+	// next is the first version after the range described by the partial version
+	next := semver.Version{Major: v.Major + 1}
+	if parts == 2 {
+		next = semver.Version{Major: v.Major, Minor: v.Minor + 1}
+	}
+	switch operator {
+	case "=", "~":
+		return []comparator{{">=", v}, {"<", next}}, nil
+	case "^":
+		return []comparator{{">=", v}, {"<", caretBound(v, parts)}}, nil
+	case ">":
+		return []comparator{{">=", next}}, nil
+	case ">=":
+		return []comparator{{">=", v}}, nil
+	case "<":
+		return []comparator{{"<", v}}, nil
+	case "<=":
+		return []comparator{{"<", next}}, nil
+	}
+	return nil, fmt.Errorf("operator %s requires a complete version", operator)
+}
+
+// caretBound returns the first version which changes the left-most non-zero part of v
+func caretBound(v semver.Version, parts int) semver.Version {
+	switch {
+	case v.Major > 0 || parts == 1:
+		return semver.Version{Major: v.Major + 1}
+	case v.Minor > 0 || parts == 2:
+		return semver.Version{Minor: v.Minor + 1}
+	}
+	return semver.Version{Patch: v.Patch + 1}
+}
+
+// parsePartialVersion parses versions like 2, 2.4, 2.4.x or 2.4.3-beta.1 and returns how many parts are given
+func parsePartialVersion(version string) (v semver.Version, parts int, err error) {
+	version = strings.TrimPrefix(strings.TrimPrefix(version, "v"), "V")
+	if version == "" {
+		return v, 0, errors.New("version is missing")
+	}
+	if full, err := semver.NewVersion(version); err == nil {
+		return *full, 3, nil
+	}
+	components := strings.Split(version, ".")
+	if len(components) > 3 {
+		return v, 0, fmt.Errorf("invalid version %q", version)
+	}
+	numbers := make([]int64, 3)
+	for i, component := range components {
+		if component == "x" || component == "X" || component == "*" {
+			continue
+		}
+		if parts < i {
+			return v, 0, fmt.Errorf("invalid version %q, wildcards can only be followed by wildcards", version)
+		}
+		numbers[i], err = strconv.ParseInt(component, 10, 64)
+		if err != nil || numbers[i] < 0 {
+			return v, 0, fmt.Errorf("invalid version %q", version)
+		}
+		parts++
+	}
+	return semver.Version{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, parts, nil
+}
+
+// ConstrainVersions only offers updates whose version satisfies the constraint. Mandatory updates outside of
+// the constraint are offered as well if a newer version satisfies it, as it can't be reached otherwise.
+func ConstrainVersions(constraint *VersionConstraint) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.constraint = constraint
+		return u
+	}
+}
+
+// constrainedUpdateAfter returns the newest update for this device which satisfies the constraint, if it is
+// newer than version. Mandatory updates outside of the constraint are stepping stones on the way to it.
+func (u *UpdateManager) constrainedUpdateAfter(constraint *VersionConstraint, version *semver.Version,
+	updates []repository.Update, compatible string) (target *semver.Version) {
+	for _, update := range updates {
+		if !version.LessThan(*update.Version) || update.Yanked || !constraint.Check(update.Version) {
+			continue
+		}
+		if len(u.bundlesFor(&update, compatible)) > 0 {
+			target = update.Version
+		}
+	}
+	return target
+}
+
+// PersistVersionConstraintIn stores the constraint set via SetVersionConstraint or PinVersion in file, so it
+// survives restarts. A constraint stored in the file takes precedence over the configured constraint.
+func PersistVersionConstraintIn(file string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.constraintFile = file
+		return u
+	}
+}
+
+func (u *UpdateManager) loadVersionConstraint() error {
+	if u.constraintFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(u.constraintFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read version constraint from %s: %w", u.constraintFile, err)
+	}
+	if raw := strings.TrimSpace(string(data)); raw != "" {
+		constraint, err := ParseVersionConstraint(raw)
+		if err != nil {
+			return fmt.Errorf("failed to load version constraint from %s: %w", u.constraintFile, err)
+		}
+		u.constraint = constraint
+	} else {
+		// An empty file means the constraint has been removed at runtime
+		u.constraint = nil
+	}
+	return nil
+}
+
+// VersionConstraint returns the constraint on versions offered as update, or an empty string if all versions
+// are acceptable
+func (u *UpdateManager) VersionConstraint() string {
+	constraint := u.versionConstraint()
+	if constraint == nil {
+		return ""
+	}
+	return constraint.String()
+}
+
+func (u *UpdateManager) versionConstraint() *VersionConstraint {
+	u.constraintLock.RLock()
+	defer u.constraintLock.RUnlock()
+	return u.constraint
+}
+
+// SetVersionConstraint replaces the constraint on versions offered as update. An empty constraint accepts all
+// versions again.
+func (u *UpdateManager) SetVersionConstraint(constraint string) error {
+	if strings.TrimSpace(constraint) == "" {
+		return u.setVersionConstraint(nil)
+	}
+	parsed, err := ParseVersionConstraint(constraint)
+	if err != nil {
+		return err
+	}
+	return u.setVersionConstraint(parsed)
+}
+
+// PinVersion only offers the given version as update. The device is not downgraded if a newer version is
+// already installed.
+func (u *UpdateManager) PinVersion(version string) error {
+	v, err := semver.NewVersion(strings.TrimPrefix(strings.TrimSpace(version), "v"))
+	if err != nil {
+		return fmt.Errorf("%w: can't pin to %q: %s", ErrInvalidConstraint, version, err)
+	}
+	return u.setVersionConstraint(ExactVersion(v))
+}
+
+func (u *UpdateManager) setVersionConstraint(constraint *VersionConstraint) error {
+	u.constraintLock.Lock()
+	defer u.constraintLock.Unlock()
+	raw := ""
+	if constraint != nil {
+		raw = constraint.String()
+	}
+	if u.constraintFile != "" {
+		if err := os.MkdirAll(filepath.Dir(u.constraintFile), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for version constraint: %w", err)
+		}
+		if err := os.WriteFile(u.constraintFile, []byte(raw+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to store version constraint: %w", err)
+		}
+	}
+	u.logger.WithFields(logrus.Fields{
+		"versionConstraint": raw,
+	}).Info("changed version constraint")
+	u.constraint = constraint
+	u.setNextUpdate(nil, nil)
+	return nil
+}
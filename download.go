@@ -0,0 +1,129 @@
+package raucgithub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultDownloadDir is used for bundle downloads unless configured otherwise. Bundles are often larger than the
+// tmpfs mounted on /tmp, so they are kept on persistent storage.
+const DefaultDownloadDir = "/var/lib/raucgithub/bundles"
+
+// DownloadBundlesTo sets the directory bundles are downloaded to, if rauc can't download them on its own
+func DownloadBundlesTo(dir string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.downloadDir = dir
+		return u
+	}
+}
+
+// RequireChecksums rejects bundles without a known checksum
+func RequireChecksums(u *UpdateManager) *UpdateManager {
+	u.requireChecksums = true
+	return u
+}
+
+// VerifyChecksumsBeforeInstall downloads all bundles with a known checksum and verifies them before rauc
+// installs them. Otherwise only bundles which need to be downloaded anyway are verified.
+func VerifyChecksumsBeforeInstall(u *UpdateManager) *UpdateManager {
+	u.verifyChecksums = true
+	return u
+}
+
+// downloadBundle downloads a bundle into the download directory and returns the path of the downloaded file.
+// If the checksum of the bundle is known, the download is verified. The caller is responsible for removing the file.
+func (u *UpdateManager) downloadBundle(ctx context.Context, candidate bundleCandidate) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, candidate.url, nil)
+	if err != nil {
+		return "", &fetchError{err: fmt.Errorf("failed to create download request: %w", err)}
+	}
+	for key, values := range candidate.header {
+		req.Header[key] = values
+	}
+	// The http client drops the Authorization header if we are redirected to another host, like the
+	// object storage GitHub uses for assets
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", &fetchError{err: fmt.Errorf("failed to download bundle: %w", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &fetchError{err: fmt.Errorf("failed to download bundle: unexpected status %s", resp.Status)}
+	}
+
+	if u.downloadDir != "" {
+		if err := os.MkdirAll(u.downloadDir, 0700); err != nil {
+			return "", fmt.Errorf("failed to create download directory: %w", err)
+		}
+	}
+	file, err := os.CreateTemp(u.downloadDir, "bundle-*.raucb")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file for bundle download: %w", err)
+	}
+	defer file.Close()
+	digest := sha256.New()
+	body := &readErrRecorder{r: resp.Body}
+	if _, err := io.Copy(io.MultiWriter(file, digest), body); err != nil {
+		os.Remove(file.Name())
+		if body.err != nil {
+			return "", &fetchError{err: fmt.Errorf("failed to download bundle: %w", err)}
+		}
+		// Writing failed, i.e. because the disk is full, which won't be different for other locations
+		return "", fmt.Errorf("failed to store downloaded bundle: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write downloaded bundle: %w", err)
+	}
+	if err := checkChecksum(digest, candidate.sha256); err != nil {
+		os.Remove(file.Name())
+		// Mirrors might serve broken or outdated copies
+		return "", &fetchError{err: err}
+	}
+	return file.Name(), nil
+}
+
+// readErrRecorder remembers read errors, so they can be told apart from write errors of io.Copy
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// verifyFileChecksum verifies bundles which are available locally, i.e. on removable media
+func verifyFileChecksum(path, expected string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer file.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return fmt.Errorf("failed to read bundle: %w", err)
+	}
+	return checkChecksum(digest, expected)
+}
+
+func checkChecksum(h hash.Hash, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != strings.ToLower(expected) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expected, actual)
+	}
+	return nil
+}
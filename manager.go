@@ -5,15 +5,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-semver/semver"
 	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/dereulenspiegel/raucgithub/repository/signature"
 	"github.com/go-co-op/gocron"
 	"github.com/holoplot/go-rauc/rauc"
 	"github.com/sirupsen/logrus"
@@ -22,6 +26,7 @@ import (
 
 var (
 	ErrNoSuitableUpdate = errors.New("no suitable update found")
+	ErrChecksumMismatch = errors.New("bundle checksum doesn't match")
 )
 
 type Status string
@@ -53,10 +58,26 @@ func IsArtifactUpdateBundle(assetName string) bool {
 	return updateBundleRegex.MatchString(assetName)
 }
 
+// bundleLocation converts file:// URLs into plain paths, as rauc expects local bundles to be given as paths
+func bundleLocation(bundleURL string) string {
+	if u, err := url.Parse(bundleURL); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	return bundleURL
+}
+
+func isRemoteBundle(bundleURL string) bool {
+	return strings.HasPrefix(bundleURL, "http://") || strings.HasPrefix(bundleURL, "https://")
+}
+
 type InstallCallback func(bool, error)
 
 type UpdateAvailableCallback func(*repository.Update)
 
+// VerificationFailedCallback is called if the signature of release metadata can't be verified. The update is
+// nil if the whole repository failed verification.
+type VerificationFailedCallback func(*repository.Update, error)
+
 func OSVersion() (string, error) {
 	file, err := os.Open("/etc/os-release")
 	if err != nil {
@@ -105,23 +126,90 @@ type UpdateManager struct {
 	logger               logrus.FieldLogger
 	extractCompatibility func(string) string
 
-	nextUpdate         *repository.Update
-	updateToPrerelease bool
+	nextUpdateLock   sync.Mutex
+	nextUpdate       *repository.Update
+	nextUpgradePath  []*semver.Version
+	downloadDir      string
+	mirrors          []string
+	requireChecksums bool
+	verifyChecksums  bool
+	proxy            *bundleProxy
 
-	scheduler       *gocron.Scheduler
-	updateCallbacks []UpdateAvailableCallback
-}
+	channelLock sync.RWMutex
+	channel     string
+	channels    []string
+	channelFile string
+
+	constraintLock sync.RWMutex
+	constraint     *VersionConstraint
+	constraintFile string
+
+	blocklist     []blockedVersions
+	blocklistFile string
 
-func UpdateToPrerelease(u *UpdateManager) *UpdateManager {
-	u.updateToPrerelease = true
-	return u
+	deviceID string
+
+	verifier repository.SignatureVerifier
+
+	scheduler                   *gocron.Scheduler
+	updateCallbacks             []UpdateAvailableCallback
+	verificationFailedCallbacks []VerificationFailedCallback
+	yankedCallbacks             []BootedVersionYankedCallback
 }
 
 func NewUpdateManagerFromConfig(repo repository.Repository, conf *viper.Viper) (*UpdateManager, error) {
 	var opts []UpdateManagerOption
-	if conf.GetBool("allowPrerelease") {
+	if channels := conf.GetStringSlice("channels"); len(channels) > 0 {
+		opts = append(opts, WithChannels(channels...))
+	}
+	if channel := conf.GetString("channel"); channel != "" {
+		opts = append(opts, SubscribeToChannel(channel))
+	} else if conf.GetBool("allowPrerelease") {
+		logrus.WithField("component", "UpdateManager").Warn("allowPrerelease is deprecated, use channel instead")
 		opts = append(opts, UpdateToPrerelease)
 	}
+	if channelFile := conf.GetString("channelFile"); channelFile != "" {
+		opts = append(opts, PersistChannelIn(channelFile))
+	}
+	if pinnedVersion := conf.GetString("pinnedVersion"); pinnedVersion != "" {
+		version, err := semver.NewVersion(strings.TrimPrefix(pinnedVersion, "v"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned version %s: %w", pinnedVersion, err)
+		}
+		opts = append(opts, ConstrainVersions(ExactVersion(version)))
+	} else if rawConstraint := conf.GetString("versionConstraint"); rawConstraint != "" {
+		constraint, err := ParseVersionConstraint(rawConstraint)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, ConstrainVersions(constraint))
+	}
+	if constraintFile := conf.GetString("versionConstraintFile"); constraintFile != "" {
+		opts = append(opts, PersistVersionConstraintIn(constraintFile))
+	}
+	if blocklist := conf.GetStringSlice("blocklist"); len(blocklist) > 0 {
+		constraints, err := parseBlocklistConstraints(blocklist)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, BlockVersions(constraints...))
+	}
+	if blocklistFile := conf.GetString("blocklistFile"); blocklistFile != "" {
+		opts = append(opts, ReadBlocklistFrom(blocklistFile))
+	}
+	if deviceID := conf.GetString("rollout.deviceID"); deviceID != "" {
+		opts = append(opts, WithDeviceID(deviceID))
+	} else if deviceIDFile := conf.GetString("rollout.deviceIDFile"); deviceIDFile != "" {
+		deviceID, err := ReadDeviceID(deviceIDFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithDeviceID(deviceID))
+	} else if deviceID, err := ReadDeviceID(DefaultDeviceIDFile); err != nil {
+		logrus.WithField("component", "UpdateManager").WithError(err).Warn("failed to identify device, staged rollouts are skipped")
+	} else {
+		opts = append(opts, WithDeviceID(deviceID))
+	}
 	if intervalString := conf.GetString("checkInterval"); intervalString != "" {
 		interval, err := time.ParseDuration(intervalString)
 		if err != nil {
@@ -129,6 +217,28 @@ func NewUpdateManagerFromConfig(repo repository.Repository, conf *viper.Viper) (
 		}
 		opts = append(opts, CheckForUpdatesEvery(interval))
 	}
+	if mirrors := conf.GetStringSlice("mirrors"); len(mirrors) > 0 {
+		opts = append(opts, WithMirrors(mirrors...))
+	}
+	if conf.GetBool("checksums.required") {
+		opts = append(opts, RequireChecksums)
+	}
+	if conf.GetBool("checksums.verifyBeforeInstall") {
+		opts = append(opts, VerifyChecksumsBeforeInstall)
+	}
+	if conf.IsSet("signatures") {
+		verifier, err := signature.LoadVerifier(conf.GetStringSlice("signatures.keys"),
+			conf.GetStringSlice("signatures.keyFiles"), conf.GetString("signatures.namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature verification configuration: %w", err)
+		}
+		opts = append(opts, VerifySignatures(verifier))
+	}
+	if conf.GetBool("proxy.enabled") {
+		opts = append(opts, StreamBundlesViaProxy(conf.GetString("proxy.listen")))
+	}
+	conf.SetDefault("downloadDir", DefaultDownloadDir)
+	opts = append(opts, DownloadBundlesTo(conf.GetString("downloadDir")))
 	return NewUpdateManager(repo, opts...)
 }
 
@@ -137,11 +247,22 @@ func NewUpdateManager(repo repository.Repository, options ...UpdateManagerOption
 	u := &UpdateManager{
 		repo:      repo,
 		scheduler: gocron.NewScheduler(time.Local),
+		channel:   repository.StableChannel,
+		channels:  DefaultChannels,
 	}
 
 	for _, opt := range options {
 		u = opt(u)
 	}
+	if err := u.loadChannel(); err != nil {
+		return nil, err
+	}
+	if err := u.loadVersionConstraint(); err != nil {
+		return nil, err
+	}
+	if !u.knowsChannel(u.channel) {
+		return nil, fmt.Errorf("%w %q, known channels are %s", ErrUnknownChannel, u.channel, strings.Join(u.channels, ", "))
+	}
 	if u.rauc == nil {
 		raucClient, err := rauc.InstallerNew()
 
@@ -165,15 +286,44 @@ func (u *UpdateManager) compatibleBundle(update *repository.Update) (compatBundl
 	if err != nil {
 		return nil, fmt.Errorf("failed to determine compatible string from rauc: %w", err)
 	}
+	if bundle := u.installableBundle(update, compatibleString, u.logger); bundle != nil {
+		return bundle, nil
+	}
+	return nil, ErrNoSuitableUpdate
+}
+
+// installableBundle returns the first bundle of the update which can be installed on devices with the given
+// compatible. Checking and installing an update both use it, so the checked bundle is the one being installed.
+func (u *UpdateManager) installableBundle(update *repository.Update, compatible string, logger logrus.FieldLogger) *repository.BundleLink {
+	for _, bundle := range u.bundlesFor(update, compatible) {
+		if u.requireChecksums && bundle.SHA256 == "" {
+			logger.WithField("bundleURL", bundle.URL).Warn("skipping bundle without checksum")
+			continue
+		}
+		return bundle
+	}
+	return nil
+}
+
+// bundlesFor returns the update bundles of an update which can be installed on devices with the given compatible
+func (u *UpdateManager) bundlesFor(update *repository.Update, compatible string) (bundles []*repository.BundleLink) {
 	for _, bundle := range update.Bundles {
+		if bundle.AssetName == "" {
+			_, bundle.AssetName = path.Split(bundle.URL)
+		}
+		if bundle.Compatibility == "" {
+			// Repositories like manifests can specify the compatibility explicitly
+			bundle.Compatibility = u.extractCompatibility(bundle.AssetName)
+		}
 		if !IsArtifactUpdateBundle(bundle.AssetName) {
+			// This is either a fresh install image, sourcecode or something else
 			continue
 		}
-		if bundle.Compatibility == compatibleString {
-			return bundle, nil
+		if bundle.Compatibility == compatible {
+			bundles = append(bundles, bundle)
 		}
 	}
-	return nil, ErrNoSuitableUpdate
+	return bundles
 }
 
 func (u *UpdateManager) checkUpdateTask() {
@@ -185,6 +335,7 @@ func (u *UpdateManager) checkUpdateTask() {
 		return
 	} else if err == ErrNoSuitableUpdate {
 		logger.Info("no new update found")
+		return
 	}
 	logger.WithFields(logrus.Fields{
 		"version":    update.Version,
@@ -196,6 +347,15 @@ func (u *UpdateManager) checkUpdateTask() {
 	}
 }
 
+// WatchRepository checks for updates whenever the repository reports changes, if the repository supports this
+func (u *UpdateManager) WatchRepository(ctx context.Context) error {
+	watcher, ok := u.repo.(repository.Watcher)
+	if !ok {
+		return nil
+	}
+	return watcher.Watch(ctx, u.checkUpdateTask)
+}
+
 func (u *UpdateManager) getOSVersionFromRauc() (string, error) {
 	bootSlotName, err := u.rauc.GetBootSlot()
 	if err != nil {
@@ -229,6 +389,10 @@ func (u *UpdateManager) RegisterUpdateAvailableCallback(cb UpdateAvailableCallba
 	u.updateCallbacks = append(u.updateCallbacks, cb)
 }
 
+func (u *UpdateManager) RegisterVerificationFailedCallback(cb VerificationFailedCallback) {
+	u.verificationFailedCallbacks = append(u.verificationFailedCallbacks, cb)
+}
+
 func (u *UpdateManager) CheckForUpdate(ctx context.Context) (*repository.Update, error) {
 	compatible, err := u.rauc.GetCompatible()
 	if err != nil {
@@ -254,61 +418,176 @@ func (u *UpdateManager) CheckForUpdate(ctx context.Context) (*repository.Update,
 		return nil,
 			fmt.Errorf("current installed version (%s) is not a semver version and can't be compared to other semver versions: %w", versionString, err)
 	}
+	if reporter, ok := u.repo.(repository.BootReporter); ok {
+		if err := reporter.BootedVersion(ctx, version); err != nil {
+			logger.WithError(err).Warn("failed to report booted version to repository")
+		}
+	}
 	possibleUpdates, err := u.repo.Updates(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load possible updates from repository: %w", err)
+		if errors.Is(err, repository.ErrInvalidSignature) || errors.Is(err, repository.ErrMissingSignature) {
+			u.verificationFailed(nil, err)
+		}
+		if !repository.IsPartial(err) {
+			return nil, fmt.Errorf("failed to load possible updates from repository: %w", err)
+		}
+		logger.WithError(err).Warn("some repositories failed, only updates of the other repositories are used")
 	}
-	// Sort updates, so we don't always accidentally select the latest update, as this might lack necessary migrations
 	sort.SliceStable(possibleUpdates, func(i, j int) bool {
 		return possibleUpdates[i].Version.LessThan(*possibleUpdates[j].Version)
 	})
 
-	for _, update := range possibleUpdates {
-		if version.LessThan(*update.Version) {
-			logger = logger.WithFields(logrus.Fields{
+	now := time.Now()
+	blocklist := u.currentBlocklist(logger)
+	u.checkBootedVersion(version, possibleUpdates, blocklist, logger)
+
+	subscribedChannel := u.Channel()
+	constraint := u.versionConstraint()
+	// Updates which will never be chosen by this device, repositories like hawkBit are told about them
+	rejections := make(map[string]error)
+	var newerUpdates []repository.Update
+	for i, update := range possibleUpdates {
+		if !version.LessThan(*update.Version) {
+			continue
+		}
+		if len(u.bundlesFor(&update, compatible)) == 0 {
+			// Releases for other boards are ignored, even mandatory ones don't need to be installed on this device
+			logger.WithField("updateVersion", update.Version.String()).Info("possible update has no compatible update bundles")
+			rejections[update.Version.String()] = fmt.Errorf("no update bundle for compatible %s", compatible)
+			continue
+		}
+		// Only releases of the subscribed channels are stepping stones, so this is checked before anything which
+		// stops at mandatory releases
+		if channel := u.ChannelOf(&update); !u.acceptsChannel(subscribedChannel, channel) {
+			logger.WithFields(logrus.Fields{
+				"updateVersion":     update.Version.String(),
+				"channel":           channel,
+				"subscribedChannel": subscribedChannel,
+			}).Info("Skipping update from other channel")
+			rejections[update.Version.String()] = fmt.Errorf("device is not subscribed to channel %s", channel)
+			continue
+		}
+		if reason, isYanked := yanked(&update, blocklist); isYanked {
+			logger.WithFields(logrus.Fields{
 				"updateVersion": update.Version.String(),
-				"updateName":    update.Name,
-				"prerelease":    update.Prerelease,
+				"yankReason":    reason,
+			}).Info("Skipping yanked update")
+			rejections[update.Version.String()] = fmt.Errorf("version has been yanked: %s", reason)
+			if update.Mandatory {
+				// Newer updates can't be reached without installing this one, they are offered again once it
+				// isn't yanked anymore
+				break
+			}
+			continue
+		}
+		if constraint != nil && !constraint.Check(update.Version) {
+			logger := logger.WithFields(logrus.Fields{
+				"updateVersion":     update.Version.String(),
+				"versionConstraint": constraint.String(),
 			})
-			if update.Prerelease && !u.updateToPrerelease {
-				logger.Info("Skipping prerelease")
+			target := u.constrainedUpdateAfter(constraint, update.Version, possibleUpdates[i+1:], compatible)
+			if !update.Mandatory || target == nil {
+				logger.Debug("Skipping update outside of version constraint")
+				rejections[update.Version.String()] = fmt.Errorf("version is outside of constraint %s", constraint)
+				if update.Mandatory {
+					// Newer updates can't be reached without installing this one
+					break
+				}
 				continue
 			}
-			var compatibleBundle *repository.BundleLink
-			// Identified possible update candidate
-			for _, bundle := range update.Bundles {
-				if bundle.AssetName == "" {
-					_, bundle.AssetName = path.Split(bundle.URL)
-				}
-				bundle.Compatibility = u.extractCompatibility(bundle.AssetName)
-				if !IsArtifactUpdateBundle(bundle.AssetName) {
-					// This is either a fresh install image, sourcecode or something else
-					continue
-				}
-				if bundle.Compatibility == compatible {
-					compatibleBundle = bundle
-					logger.WithField("bundleURL", bundle.URL).Info("identified possible next update")
-				}
+			// Versions within the constraint can't be reached without installing this one
+			logger.WithField("targetVersion", target.String()).
+				Info("mandatory update outside of version constraint is required to reach the constraint")
+		}
+		percentage := repository.RolloutPercentageAt(&update, now)
+		if selected, err := u.inRollout(percentage, update.Version); !selected {
+			logger := logger.WithFields(logrus.Fields{
+				"updateVersion":     update.Version.String(),
+				"rolloutPercentage": percentage,
+			})
+			if err != nil {
+				logger = logger.WithError(err)
 			}
-			if compatibleBundle != nil {
-				u.nextUpdate = &update
-				return &update, nil
+			logger.Info("Skipping update as the device is not part of its staged rollout yet")
+			if update.Mandatory {
+				// Newer updates can't be reached without installing this one
+				break
 			}
-			logger.Info("possible update has no compatible update bundles")
+			continue
 		}
+		newerUpdates = append(newerUpdates, update)
+	}
+	if len(newerUpdates) == 0 {
+		u.rejectUpdates(ctx, version, possibleUpdates, nil, rejections)
+		return nil, ErrNoSuitableUpdate
+	}
+	// Releases with migrations which can't be skipped are marked as mandatory or declare a minimum version, so
+	// the newest update which can be installed directly is chosen
+	for _, update := range reachableUpdates(version, newerUpdates) {
+		update := update
+		logger := logger.WithFields(logrus.Fields{
+			"updateVersion": update.Version.String(),
+			"updateName":    update.Name,
+			"prerelease":    update.Prerelease,
+			"channel":       u.ChannelOf(&update),
+		})
+		// Identified possible update candidate
+		if u.verifier != nil && !update.Verified {
+			if err := repository.AttachVerifiedChecksums(ctx, http.DefaultClient, &update, u.verifier); err != nil {
+				logger.WithError(err).Error("refusing update as its metadata can't be verified")
+				u.verificationFailed(&update, err)
+				rejections[update.Version.String()] = err
+				continue
+			}
+		}
+		if bundle := u.installableBundle(&update, compatible, logger); bundle != nil {
+			logger.WithField("bundleURL", bundle.URL).Info("identified possible next update")
+			path := append([]*semver.Version{update.Version}, upgradePath(update.Version, newerUpdates)...)
+			if len(path) > 1 {
+				logger.WithField("upgradePath", path).Info("newest update can only be reached via intermediate updates")
+			}
+			u.setNextUpdate(&update, path)
+			u.rejectUpdates(ctx, version, possibleUpdates, &update, rejections)
+			return &update, nil
+		}
+		logger.Info("possible update has no update bundle with checksum")
+		rejections[update.Version.String()] = fmt.Errorf("no update bundle with checksum for compatible %s", compatible)
 	}
+	u.rejectUpdates(ctx, version, possibleUpdates, nil, rejections)
 	return nil, ErrNoSuitableUpdate
 
 }
 
+func (u *UpdateManager) setNextUpdate(update *repository.Update, path []*semver.Version) {
+	u.nextUpdateLock.Lock()
+	defer u.nextUpdateLock.Unlock()
+	u.nextUpdate = update
+	u.nextUpgradePath = path
+}
+
+func (u *UpdateManager) getNextUpdate() *repository.Update {
+	u.nextUpdateLock.Lock()
+	defer u.nextUpdateLock.Unlock()
+	return u.nextUpdate
+}
+
+// UpgradePath returns the versions which need to be installed one after another to reach the newest update,
+// starting with the next update. It is empty if no update has been found by the last check.
+func (u *UpdateManager) UpgradePath() []*semver.Version {
+	u.nextUpdateLock.Lock()
+	defer u.nextUpdateLock.Unlock()
+	return append([]*semver.Version(nil), u.nextUpgradePath...)
+}
+
 func (u *UpdateManager) InstallNextUpdate(ctx context.Context) (err error) {
-	if u.nextUpdate == nil {
-		u.nextUpdate, err = u.CheckForUpdate(ctx)
+	update := u.getNextUpdate()
+	if update == nil {
+		update, err = u.CheckForUpdate(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to determine next suitable update: %w", err)
 		}
 	}
-	return u.InstallUpdate(ctx, u.nextUpdate)
+	return u.InstallUpdate(ctx, update)
 }
 
 func (u *UpdateManager) InstallUpdate(ctx context.Context, update *repository.Update) (err error) {
@@ -322,7 +601,29 @@ func (u *UpdateManager) InstallUpdate(ctx context.Context, update *repository.Up
 		"bundleURL":     bundle.URL,
 	})
 	logger.Info("Starting update")
-	err = u.rauc.InstallBundle(bundle.URL, rauc.InstallBundleOptions{IgnoreIncompatible: false})
+	if authorizer, ok := u.repo.(repository.BundleAuthorizer); ok {
+		header, err := authorizer.BundleHeader(ctx, update, bundle)
+		if err != nil {
+			return fmt.Errorf("failed to authorize download of bundle: %w", err)
+		}
+		if header != nil {
+			authorized := *bundle
+			authorized.Header = header
+			bundle = &authorized
+		}
+	}
+	reporter, reportInstall := u.repo.(repository.InstallReporter)
+	if reportInstall {
+		if err := reporter.InstallStarted(ctx, update); err != nil {
+			logger.WithError(err).Warn("failed to report start of installation to repository")
+		}
+	}
+	err = u.installBundle(ctx, bundle)
+	if reportInstall {
+		if err := reporter.InstallFinished(ctx, update, err); err != nil {
+			logger.WithError(err).Warn("failed to report result of installation to repository")
+		}
+	}
 	if err != nil {
 		logger.WithError(err).Error("failed to install bundle")
 		return fmt.Errorf("failed to install bundle: %w", err)
@@ -330,15 +631,84 @@ func (u *UpdateManager) InstallUpdate(ctx context.Context, update *repository.Up
 	return nil
 }
 
+// installBundle tries all locations of the bundle in order until one of them can be installed
+func (u *UpdateManager) installBundle(ctx context.Context, bundle *repository.BundleLink) (err error) {
+	candidates := u.bundleCandidates(bundle)
+	for i, candidate := range candidates {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		err = u.installBundleFrom(ctx, candidate)
+		if err == nil {
+			return nil
+		}
+		if !isFetchError(err) {
+			// The bundle itself can't be installed, other locations would fail the same way
+			return err
+		}
+		if i < len(candidates)-1 {
+			u.logger.WithError(err).WithField("bundleURL", candidate.url).Warn("failed to install bundle, trying next mirror")
+		}
+	}
+	if len(candidates) > 1 {
+		return fmt.Errorf("all %d locations of the bundle failed, last error: %w", len(candidates), err)
+	}
+	return err
+}
+
+func (u *UpdateManager) installBundleFrom(ctx context.Context, candidate bundleCandidate) error {
+	location := bundleLocation(candidate.url)
+	if u.verifyChecksums && candidate.sha256 != "" && !isRemoteBundle(candidate.url) {
+		if err := verifyFileChecksum(location, candidate.sha256); err != nil {
+			return &fetchError{err: err}
+		}
+	} else if u.verifyChecksums && candidate.sha256 != "" {
+		downloaded, err := u.downloadBundle(ctx, candidate)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(downloaded)
+		location = downloaded
+	} else if u.proxy != nil && isRemoteBundle(candidate.url) {
+		proxyURL, revoke, err := u.proxy.allow(candidate)
+		if err != nil {
+			return err
+		}
+		defer revoke()
+		location = proxyURL
+	} else if len(candidate.header) > 0 {
+		// rauc can't send additional headers, so these bundles need to be downloaded first
+		downloaded, err := u.downloadBundle(ctx, candidate)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(downloaded)
+		location = downloaded
+	}
+	if candidate.sha256 != "" && isRemoteBundle(location) {
+		// rauc streams the bundle and only verifies its signature, the checksum is only verified for downloads
+		u.logger.WithField("bundleURL", candidate.url).
+			Warn("bundle is streamed, its checksum is not verified unless checksums.verifyBeforeInstall is enabled")
+	}
+	if err := u.rauc.InstallBundle(location, rauc.InstallBundleOptions{IgnoreIncompatible: false}); err != nil {
+		return raucFetchError(location, err)
+	}
+	return nil
+}
+
 func (u *UpdateManager) InstallNextUpdateAsync(ctx context.Context, callback InstallCallback) chan int32 {
 	var err error
-	if u.nextUpdate != nil {
-		u.nextUpdate, err = u.CheckForUpdate(ctx)
+	update := u.getNextUpdate()
+	if update == nil {
+		update, err = u.CheckForUpdate(ctx)
 		if err != nil {
-			callback(false, fmt.Errorf("failed to determine stuitable next update: %w", err))
+			callback(false, fmt.Errorf("failed to determine suitable next update: %w", err))
+			progress := make(chan int32)
+			close(progress)
+			return progress
 		}
 	}
-	return u.InstallUpdateAsync(ctx, u.nextUpdate, callback)
+	return u.InstallUpdateAsync(ctx, update, callback)
 }
 
 func (u *UpdateManager) InstallUpdateAsync(ctx context.Context, update *repository.Update, callback InstallCallback) chan int32 {
@@ -390,10 +760,12 @@ func (u *UpdateManager) InstallUpdateAsync(ctx context.Context, update *reposito
 
 				// Do a non blocking write as the client might not read from the output channel
 				if percentage != int32(lastPercentage) {
+					lastPercentage = int(percentage)
 					select {
 					case outputChan <- percentage:
 					default:
 					}
+					u.reportInstallProgress(ctx, update, percentage)
 				}
 
 			}
@@ -403,6 +775,57 @@ func (u *UpdateManager) InstallUpdateAsync(ctx context.Context, update *reposito
 	return outputChan
 }
 
+func (u *UpdateManager) reportInstallProgress(ctx context.Context, update *repository.Update, percentage int32) {
+	reporter, ok := u.repo.(repository.InstallReporter)
+	if !ok {
+		return
+	}
+	if err := reporter.InstallProgress(ctx, update, percentage); err != nil {
+		u.logger.WithError(err).Warn("failed to report installation progress to repository")
+	}
+}
+
+// RepositoryStatus returns diagnostic details of the repository, i.e. the remaining API rate limit. It is empty
+// if the repository doesn't report its status.
+func (u *UpdateManager) RepositoryStatus() map[string]string {
+	status := make(map[string]string)
+	if reporter, ok := u.repo.(repository.StatusReporter); ok {
+		for key, value := range reporter.RepositoryStatus() {
+			status[key] = value
+		}
+	}
+	return status
+}
+
+// rejectUpdates tells the repository about all updates which won't be installed. Updates which might still be
+// chosen later, i.e. because of a staged rollout, are left alone.
+func (u *UpdateManager) rejectUpdates(ctx context.Context, version *semver.Version, updates []repository.Update,
+	chosen *repository.Update, rejections map[string]error) {
+	rejecter, ok := u.repo.(repository.UpdateRejecter)
+	if !ok {
+		return
+	}
+	for i := range updates {
+		update := &updates[i]
+		reason, rejected := rejections[update.Version.String()]
+		switch {
+		case update.Version.Equal(*version):
+			reason, rejected = repository.ErrAlreadyInstalled, true
+		case update.Version.LessThan(*version):
+			reason, rejected = fmt.Errorf("newer version %s is already installed", version), true
+		case !rejected && chosen != nil && update.Version.LessThan(*chosen.Version):
+			reason, rejected = fmt.Errorf("superseded by version %s", chosen.Version), true
+		}
+		if !rejected {
+			continue
+		}
+		if err := rejecter.UpdateRejected(ctx, update, reason); err != nil {
+			u.logger.WithError(err).WithField("updateVersion", update.Version.String()).
+				Warn("failed to report rejected update to repository")
+		}
+	}
+}
+
 func (u *UpdateManager) Progress(ctx context.Context) (int32, error) {
 	operation, err := u.rauc.GetOperation()
 	if err != nil {
@@ -2,6 +2,16 @@ package raucgithub
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -9,6 +19,7 @@ import (
 	"github.com/coreos/go-semver/semver"
 	"github.com/dereulenspiegel/raucgithub/mocks"
 	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/dereulenspiegel/raucgithub/repository/checksum"
 	dbus "github.com/godbus/dbus/v5"
 	"github.com/holoplot/go-rauc/rauc"
 	"github.com/stretchr/testify/assert"
@@ -258,3 +269,941 @@ func TestRunUpdate(t *testing.T) {
 	wg.Wait()
 	assert.GreaterOrEqual(t, len(updateChan), 1)
 }
+
+func TestRunUpdateWithoutSuitableUpdate(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient))
+	require.NoError(t, err)
+
+	repo.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Version: semver.New("1.6.6"),
+		},
+	}, nil)
+	expectBootedVersion(raucClient, "1.8.1")
+
+	calls := 0
+	updateChan := updater.InstallNextUpdateAsync(context.Background(), func(success bool, err error) {
+		calls++
+		assert.False(t, success)
+		assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+	})
+	_, open := <-updateChan
+	assert.False(t, open, "progress channel must be closed if there is nothing to install")
+	assert.Equal(t, 1, calls)
+	raucClient.AssertNotCalled(t, "InstallBundle", mock.Anything, mock.Anything)
+}
+
+func TestInstallFirstCompatibleBundle(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient))
+	require.NoError(t, err)
+
+	repo.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:    "Penguin",
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+				{URL: "https://mirror.example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+			},
+		},
+	}, nil)
+	expectBootedVersion(raucClient, "1.8.1")
+	raucClient.EXPECT().InstallBundle("https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin", mock.Anything).Return(nil)
+
+	_, err = updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, updater.InstallNextUpdate(context.Background()))
+}
+
+func TestInstallBundleWithHeaders(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/octet-stream", r.Header.Get("Accept"))
+		w.Write([]byte("bundle"))
+	}))
+	t.Cleanup(srv.Close)
+
+	downloadDir := t.TempDir()
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), DownloadBundlesTo(downloadDir))
+	require.NoError(t, err)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Set("Accept", "application/octet-stream")
+	update := &repository.Update{
+		Name:    "Penguin",
+		Version: semver.New("1.8.2"),
+		Bundles: []*repository.BundleLink{
+			{
+				URL:           srv.URL + "/repos/owner/repo/releases/assets/1",
+				AssetName:     "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				Compatibility: "cbpifw-raspberrypi3-64",
+				Header:        header,
+			},
+		},
+	}
+
+	raucClient.EXPECT().GetCompatible().Return("cbpifw-raspberrypi3-64", nil)
+	raucClient.EXPECT().InstallBundle(mock.Anything, mock.Anything).Run(func(filename string, options rauc.InstallBundleOptions) {
+		assert.Equal(t, downloadDir, filepath.Dir(filename))
+		content, err := os.ReadFile(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, "bundle", string(content))
+	}).Return(nil)
+
+	require.NoError(t, updater.InstallUpdate(context.Background(), update))
+	entries, err := os.ReadDir(downloadDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "downloaded bundle should have been removed")
+}
+
+// authorizingRepo hands out a new token for every download
+type authorizingRepo struct {
+	tokens int
+}
+
+func (r *authorizingRepo) Updates(ctx context.Context) ([]repository.Update, error) {
+	return nil, nil
+}
+
+func (r *authorizingRepo) BundleHeader(ctx context.Context, update *repository.Update, bundle *repository.BundleLink) (http.Header, error) {
+	r.tokens++
+	return http.Header{"Authorization": {fmt.Sprintf("Bearer token%d", r.tokens)}}, nil
+}
+
+func TestInstallBundleAuthorizedByRepository(t *testing.T) {
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token1", r.Header.Get("Authorization"))
+		w.Write([]byte("bundle"))
+	}))
+	t.Cleanup(srv.Close)
+
+	repo := &authorizingRepo{}
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), DownloadBundlesTo(t.TempDir()))
+	require.NoError(t, err)
+
+	update := &repository.Update{
+		Name:    "Penguin",
+		Version: semver.New("1.8.2"),
+		Bundles: []*repository.BundleLink{
+			{
+				URL:           srv.URL + "/v2/firmware/blobs/sha256:1111",
+				AssetName:     "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				Compatibility: "cbpifw-raspberrypi3-64",
+			},
+		},
+	}
+
+	raucClient.EXPECT().GetCompatible().Return("cbpifw-raspberrypi3-64", nil)
+	raucClient.EXPECT().InstallBundle(mock.Anything, mock.Anything).Return(nil)
+
+	require.NoError(t, updater.InstallUpdate(context.Background(), update))
+	assert.Equal(t, 1, repo.tokens)
+	assert.Nil(t, update.Bundles[0].Header, "the header must not be stored with the update")
+}
+
+func TestInstallBundleFallsBackToMirrors(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), WithMirrors("http://cache.lan/firmware/"))
+	require.NoError(t, err)
+
+	update := &repository.Update{
+		Name:    "Penguin",
+		Version: semver.New("1.8.2"),
+		Bundles: []*repository.BundleLink{
+			{
+				URL:           "https://github.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				AssetName:     "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				Compatibility: "cbpifw-raspberrypi3-64",
+				Mirrors:       []string{"https://mirror.example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+			},
+		},
+	}
+
+	raucClient.EXPECT().GetCompatible().Return("cbpifw-raspberrypi3-64", nil)
+	var tried []string
+	raucClient.EXPECT().InstallBundle(mock.Anything, mock.Anything).Run(func(filename string, options rauc.InstallBundleOptions) {
+		tried = append(tried, filename)
+	}).Return(errors.New("connection refused")).Twice()
+	raucClient.EXPECT().InstallBundle(mock.Anything, mock.Anything).Run(func(filename string, options rauc.InstallBundleOptions) {
+		tried = append(tried, filename)
+	}).Return(nil).Once()
+
+	require.NoError(t, updater.InstallUpdate(context.Background(), update))
+	assert.Equal(t, []string{
+		"http://cache.lan/firmware/cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+		"https://github.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+		"https://mirror.example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+	}, tried)
+}
+
+func TestInstallBundleDoesNotRetryBundleErrors(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), WithMirrors("http://cache.lan/firmware/"))
+	require.NoError(t, err)
+
+	update := &repository.Update{
+		Name:    "Penguin",
+		Version: semver.New("1.8.2"),
+		Bundles: []*repository.BundleLink{
+			{
+				URL:           "https://github.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				AssetName:     "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				Compatibility: "cbpifw-raspberrypi3-64",
+			},
+		},
+	}
+
+	raucClient.EXPECT().GetCompatible().Return("cbpifw-raspberrypi3-64", nil)
+	// Every copy of the bundle has the same signature, so other locations are not tried
+	raucClient.EXPECT().InstallBundle("http://cache.lan/firmware/cbpifw-raspberrypi3-64_v1.8.2_update.bin", mock.Anything).
+		Return(errors.New("signature verification failed: certificate has expired")).Once()
+
+	err = updater.InstallUpdate(context.Background(), update)
+	assert.ErrorContains(t, err, "signature verification failed")
+}
+
+func TestStreamBundleViaProxy(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	content := "0123456789abcdef"
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		http.ServeContent(w, r, "bundle", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(storage.Close)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		http.Redirect(w, r, storage.URL+"/assets/1", http.StatusFound)
+	}))
+	t.Cleanup(api.Close)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), StreamBundlesViaProxy(""))
+	require.NoError(t, err)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	update := &repository.Update{
+		Name:    "Penguin",
+		Version: semver.New("1.8.2"),
+		Bundles: []*repository.BundleLink{
+			{
+				URL:           api.URL + "/repos/owner/repo/releases/assets/1",
+				AssetName:     "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				Compatibility: "cbpifw-raspberrypi3-64",
+				Header:        header,
+			},
+		},
+	}
+
+	var proxyURL string
+	raucClient.EXPECT().GetCompatible().Return("cbpifw-raspberrypi3-64", nil)
+	raucClient.EXPECT().InstallBundle(mock.Anything, mock.Anything).Run(func(filename string, options rauc.InstallBundleOptions) {
+		proxyURL = filename
+		assert.True(t, strings.HasPrefix(filename, "http://127.0.0.1:"))
+
+		req, err := http.NewRequest(http.MethodGet, filename, nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", "bytes=4-7")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "bytes 4-7/16", resp.Header.Get("Content-Range"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "4567", string(body))
+	}).Return(nil)
+
+	require.NoError(t, updater.InstallUpdate(context.Background(), update))
+
+	// The bundle must not be available anymore after the installation
+	resp, err := http.Get(proxyURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// expectBootedVersion lets the rauc mock report the given version as booted on a cbpifw-raspberrypi3-64
+func expectBootedVersion(raucClient *mocks.RaucDBUSClient, version string) {
+	raucClient.EXPECT().GetBootSlot().Return("slot0", nil)
+	raucClient.EXPECT().GetCompatible().Return("cbpifw-raspberrypi3-64", nil)
+	raucClient.EXPECT().GetSlotStatus().Return([]rauc.SlotStatus{
+		{
+			SlotName: "slot0",
+			Status: map[string]dbus.Variant{
+				"bundle.version": dbus.MakeVariant(version),
+			},
+		},
+	}, nil)
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	bundle := "signed rauc bundle"
+	sum := sha256.Sum256([]byte(bundle))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/SHA256SUMS":
+			fmt.Fprintf(w, "%x  cbpifw-raspberrypi3-64_v1.8.2_update.bin\n", sum)
+		case "/mirror/cbpifw-raspberrypi3-64_v1.8.2_update.bin":
+			w.Write([]byte("truncated"))
+		default:
+			w.Write([]byte(bundle))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	downloadDir := t.TempDir()
+	// Checksum files are parsed in the repository layer
+	updater, err := NewUpdateManager(checksum.New(repo), WithRaucClient(raucClient), RequireChecksums,
+		VerifyChecksumsBeforeInstall, DownloadBundlesTo(downloadDir), WithMirrors(srv.URL+"/mirror"))
+	require.NoError(t, err)
+
+	repo.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:    "Without checksums",
+			Version: semver.New("1.8.1"),
+			Bundles: []*repository.BundleLink{
+				{URL: srv.URL + "/cbpifw-raspberrypi3-64_v1.8.1_update.bin"},
+			},
+		},
+		{
+			Name:    "Penguin",
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{URL: srv.URL + "/cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+				{URL: srv.URL + "/SHA256SUMS", AssetName: "SHA256SUMS"},
+			},
+		},
+	}, nil)
+	expectBootedVersion(raucClient, "1.8.0")
+
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Penguin", update.Name)
+	assert.Equal(t, fmt.Sprintf("%x", sum), update.Bundles[0].SHA256)
+
+	// The mirror serves a broken copy, so the bundle is taken from the repository
+	raucClient.EXPECT().InstallBundle(mock.Anything, mock.Anything).Run(func(filename string, options rauc.InstallBundleOptions) {
+		content, err := os.ReadFile(filename)
+		assert.NoError(t, err)
+		assert.Equal(t, bundle, string(content))
+	}).Return(nil).Once()
+	require.NoError(t, updater.InstallUpdate(context.Background(), update))
+}
+
+// signatureStub accepts signatures which equal "signed by release key"
+type signatureStub struct{}
+
+func (signatureStub) Verify(message, signature []byte) error {
+	if string(signature) != "signed by release key" {
+		return repository.ErrInvalidSignature
+	}
+	return nil
+}
+
+func TestVerifySignatures(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "SHA256SUMS":
+			fmt.Fprintf(w, "%s  cbpifw-raspberrypi3-64_%s_update.bin\n", strings.Repeat("ab", 32), path.Dir(r.URL.Path)[1:])
+		case "SHA256SUMS.minisig":
+			if path.Dir(r.URL.Path) == "/v1.8.3" {
+				w.Write([]byte("forged"))
+				return
+			}
+			w.Write([]byte("signed by release key"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), VerifySignatures(signatureStub{}))
+	require.NoError(t, err)
+	failed := make(chan *repository.Update, 1)
+	updater.RegisterVerificationFailedCallback(func(update *repository.Update, err error) {
+		assert.ErrorIs(t, err, repository.ErrInvalidSignature)
+		failed <- update
+	})
+
+	newUpdate := func(version string) repository.Update {
+		return repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: srv.URL + "/v" + version + "/cbpifw-raspberrypi3-64_v" + version + "_update.bin", SHA256: strings.Repeat("cd", 32)},
+				{URL: srv.URL + "/v" + version + "/SHA256SUMS", AssetName: "SHA256SUMS"},
+				{URL: srv.URL + "/v" + version + "/SHA256SUMS.minisig", AssetName: "SHA256SUMS.minisig"},
+			},
+		}
+	}
+	repo.EXPECT().Updates(mock.Anything).Return([]repository.Update{newUpdate("1.8.2"), newUpdate("1.8.3")}, nil)
+	expectBootedVersion(raucClient, "1.8.0")
+
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.2", update.Name)
+	// Hashes not covered by the signature are replaced
+	assert.Equal(t, strings.Repeat("ab", 32), update.Bundles[0].SHA256)
+
+	select {
+	case rejected := <-failed:
+		assert.Equal(t, "1.8.3", rejected.Name)
+	case <-time.After(time.Second):
+		t.Fatal("verification failure has not been reported")
+	}
+}
+
+func TestVerificationFailedInOneRepository(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient))
+	require.NoError(t, err)
+	failed := make(chan error, 1)
+	updater.RegisterVerificationFailedCallback(func(update *repository.Update, err error) {
+		failed <- err
+	})
+
+	partial := &repository.PartialError{Errs: []error{fmt.Errorf("manifest: %w", repository.ErrInvalidSignature)}}
+	repo.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:    "Penguin",
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+			},
+		},
+	}, partial)
+	expectBootedVersion(raucClient, "1.8.1")
+
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Penguin", update.Name)
+	select {
+	case err := <-failed:
+		assert.ErrorIs(t, err, repository.ErrInvalidSignature)
+	case <-time.After(time.Second):
+		t.Fatal("verification failure has not been reported")
+	}
+}
+
+func TestChannels(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	newUpdate := func(version string) repository.Update {
+		v := semver.New(version)
+		return repository.Update{
+			Name:       version,
+			Version:    v,
+			Prerelease: v.PreRelease != "",
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v" + version + "_update.bin"},
+			},
+		}
+	}
+	internal := newUpdate("1.8.5")
+	internal.Channel = "internal"
+	repo.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		newUpdate("1.8.3-nightly.20230120"), newUpdate("1.8.4-beta.1"), internal,
+	}, nil)
+	expectBootedVersion(raucClient, "1.8.1")
+
+	channelFile := filepath.Join(t.TempDir(), "channel")
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), PersistChannelIn(channelFile))
+	require.NoError(t, err)
+	assert.Equal(t, "stable", updater.Channel())
+
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+
+	require.NoError(t, updater.SetChannel("beta"))
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.4-beta.1", update.Name)
+
+	require.NoError(t, updater.SetChannel("Nightly"))
+	update, err = updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.4-beta.1", update.Name)
+
+	assert.ErrorIs(t, updater.SetChannel("unknown"), ErrUnknownChannel)
+
+	// The selected channel survives a restart
+	updater, err = NewUpdateManager(repo, WithRaucClient(raucClient), SubscribeToChannel("beta"), PersistChannelIn(channelFile))
+	require.NoError(t, err)
+	assert.Equal(t, "nightly", updater.Channel())
+
+	updater, err = NewUpdateManager(repo, WithRaucClient(raucClient), UpdateToPrerelease)
+	require.NoError(t, err)
+	update, err = updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.5", update.Name)
+}
+
+func TestUnknownPrereleaseNames(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	repo.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:       "1.8.2-rc1",
+			Version:    semver.New("1.8.2-rc1"),
+			Prerelease: true,
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.8.2-rc1_update.bin"},
+			},
+		},
+	}, nil)
+	expectBootedVersion(raucClient, "1.8.1")
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient))
+	require.NoError(t, err)
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+
+	// rc is no known channel, so release candidates are published on beta
+	require.NoError(t, updater.SetChannel("beta"))
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.2-rc1", update.Name)
+	assert.Equal(t, repository.PrereleaseChannel, updater.ChannelOf(update))
+}
+
+func TestSteppingStones(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	updates := []repository.Update{}
+	for _, version := range []string{"1.9.0", "1.8.2", "1.8.3", "1.10.0", "2.0.0", "2.1.0"} {
+		updates = append(updates, repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v" + version + "_update.bin"},
+			},
+		})
+	}
+	// 1.9.0 migrates the database and can't be skipped, 2.0.0 can only be installed on top of 1.10.0
+	updates[0].Mandatory = true
+	updates[4].MinimumVersion = semver.New("1.10.0")
+	updates[5].MinimumVersion = semver.New("1.10.0")
+	// There is no bundle for this device, so the update is skipped
+	updates[2].Bundles[0].URL = "https://example.com/cbpifw-raspberrypi4-64_v1.8.3_update.bin"
+	repo.EXPECT().Updates(mock.Anything).Return(updates, nil)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient))
+	require.NoError(t, err)
+
+	for booted, expected := range map[string]string{
+		"1.8.1":  "1.9.0",
+		"1.8.2":  "1.9.0",
+		"1.9.0":  "1.10.0",
+		"1.10.0": "2.1.0",
+	} {
+		raucClient.ExpectedCalls = nil
+		expectBootedVersion(raucClient, booted)
+		update, err := updater.CheckForUpdate(context.Background())
+		require.NoError(t, err, booted)
+		assert.Equal(t, expected, update.Name, booted)
+	}
+}
+
+func TestMandatoryReleaseForOtherBoard(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	updates := []repository.Update{}
+	for _, version := range []string{"1.9.0", "1.10.0", "2.0.0"} {
+		updates = append(updates, repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v" + version + "_update.bin"},
+			},
+		})
+	}
+	// 1.9.0 only migrates the other board, devices of this board can skip it
+	updates[0].Mandatory = true
+	updates[0].Bundles[0].URL = "https://example.com/cbpifw-raspberrypi4-64_v1.9.0_update.bin"
+	updates[2].MinimumVersion = semver.New("1.10.0")
+	repo.EXPECT().Updates(mock.Anything).Return(updates, nil)
+	expectBootedVersion(raucClient, "1.8.1")
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient))
+	require.NoError(t, err)
+
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.10.0", update.Name)
+	assert.Equal(t, []*semver.Version{semver.New("1.10.0"), semver.New("2.0.0")}, updater.UpgradePath())
+}
+
+func TestUpgradePath(t *testing.T) {
+	updates := []repository.Update{
+		{Version: semver.New("1.8.2")},
+		{Version: semver.New("1.9.0"), Mandatory: true},
+		{Version: semver.New("1.10.0")},
+		{Version: semver.New("2.0.0"), MinimumVersion: semver.New("1.10.0")},
+		{Version: semver.New("3.0.0"), MinimumVersion: semver.New("2.5.0")},
+	}
+	path := upgradePath(semver.New("1.8.1"), updates)
+	assert.Equal(t, []*semver.Version{semver.New("1.9.0"), semver.New("1.10.0"), semver.New("2.0.0")}, path)
+}
+
+func TestVersionConstraint(t *testing.T) {
+	for constraint, expected := range map[string]map[string]bool{
+		">=2.1.0 <3.0.0":  {"2.0.9": false, "2.1.0": true, "2.9.9": true, "3.0.0-beta.1": false, "3.0.0": false},
+		">= 2.1, < 3":     {"2.0.9": false, "2.1.0": true, "3.0.0": false},
+		"~2.4":            {"2.3.9": false, "2.4.0": true, "2.4.7": true, "2.5.0": false},
+		"~2.4.3":          {"2.4.2": false, "2.4.3": true, "2.5.0": false},
+		"^2.4":            {"2.3.0": false, "2.4.0": true, "2.9.0": true, "3.0.0": false},
+		"^0.4.2":          {"0.4.1": false, "0.4.2": true, "0.5.0": false},
+		"2.x":             {"1.9.9": false, "2.0.0": true, "2.7.1": true, "3.0.0": false},
+		"v2.4.3":          {"2.4.2": false, "2.4.3": true, "2.4.4": false},
+		">2.4 <=2.6":      {"2.4.9": false, "2.5.0": true, "2.6.9": true, "2.7.0": false},
+		"2.1 - 2.4":       {"2.0.0": false, "2.1.0": true, "2.4.9": true, "2.5.0": false},
+		"~1.8 || >=2.4.0": {"1.8.5": true, "1.9.0": false, "2.4.0": true},
+		"*":               {"0.0.1": true, "9.9.9": true},
+		">=2.0.0 !=2.2.0": {"2.1.0": true, "2.2.0": false, "2.3.0": true},
+	} {
+		c, err := ParseVersionConstraint(constraint)
+		require.NoError(t, err, constraint)
+		for version, matches := range expected {
+			assert.Equal(t, matches, c.Check(semver.New(version)), "%s %s", constraint, version)
+		}
+	}
+
+	for _, invalid := range []string{"", ">>2.0", "2.x.3", "!=2.4", "~foo", ">=2.0 ||"} {
+		_, err := ParseVersionConstraint(invalid)
+		assert.ErrorIs(t, err, ErrInvalidConstraint, invalid)
+	}
+}
+
+func TestPinVersion(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	var updates []repository.Update
+	for _, version := range []string{"2.4.3", "2.5.0", "3.0.0"} {
+		updates = append(updates, repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v" + version + "_update.bin"},
+			},
+		})
+	}
+	repo.EXPECT().Updates(mock.Anything).Return(updates, nil)
+	expectBootedVersion(raucClient, "2.4.0")
+
+	constraint, err := ParseVersionConstraint("~2.4")
+	require.NoError(t, err)
+	constraintFile := filepath.Join(t.TempDir(), "version-constraint")
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), ConstrainVersions(constraint),
+		PersistVersionConstraintIn(constraintFile))
+	require.NoError(t, err)
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "2.4.3", update.Name)
+
+	require.NoError(t, updater.SetVersionConstraint("<3"))
+	update, err = updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "2.5.0", update.Name)
+
+	require.NoError(t, updater.PinVersion("v2.4.3"))
+	assert.Equal(t, "=2.4.3", updater.VersionConstraint())
+	update, err = updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "2.4.3", update.Name)
+	assert.ErrorIs(t, updater.PinVersion("2.4"), ErrInvalidConstraint)
+
+	// The pinned version survives a restart
+	updater, err = NewUpdateManager(repo, WithRaucClient(raucClient), ConstrainVersions(constraint),
+		PersistVersionConstraintIn(constraintFile))
+	require.NoError(t, err)
+	assert.Equal(t, "=2.4.3", updater.VersionConstraint())
+
+	require.NoError(t, updater.SetVersionConstraint(""))
+	update, err = updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "3.0.0", update.Name)
+}
+
+func TestPinnedVersionBehindMandatoryRelease(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	var updates []repository.Update
+	for _, version := range []string{"2.2.0", "2.3.0", "2.4.3", "3.0.0"} {
+		updates = append(updates, repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v" + version + "_update.bin"},
+			},
+		})
+	}
+	updates[0].Mandatory = true
+	updates[3].Mandatory = true
+	repo.EXPECT().Updates(mock.Anything).Return(updates, nil)
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), ConstrainVersions(ExactVersion(semver.New("2.4.3"))))
+	require.NoError(t, err)
+
+	// The pinned version can only be reached via the mandatory 2.2.0
+	expectBootedVersion(raucClient, "2.1.0")
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "2.2.0", update.Name)
+	assert.Equal(t, []*semver.Version{semver.New("2.2.0"), semver.New("2.4.3")}, updater.UpgradePath())
+
+	raucClient.ExpectedCalls = nil
+	expectBootedVersion(raucClient, "2.2.0")
+	update, err = updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "2.4.3", update.Name)
+
+	// Mandatory releases beyond the pinned version are never installed
+	raucClient.ExpectedCalls = nil
+	expectBootedVersion(raucClient, "2.4.3")
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+}
+
+func TestYankedReleases(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	var updates []repository.Update
+	for _, version := range []string{"1.8.1", "1.8.2", "1.8.3", "1.8.4"} {
+		updates = append(updates, repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v" + version + "_update.bin"},
+			},
+		})
+	}
+	updates[0].Yanked, updates[0].YankReason = true, "Breaks the temperature sensor"
+	updates[3].Yanked = true
+	repo.EXPECT().Updates(mock.Anything).Return(updates, nil)
+	expectBootedVersion(raucClient, "1.8.1")
+
+	blocklistFile := filepath.Join(t.TempDir(), "blocklist")
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("# Withdrawn after release\n1.8.3 # bricks the display\n"), 0644))
+	blocked, err := ParseVersionConstraint("1.8.2")
+	require.NoError(t, err)
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), BlockVersions(blocked), ReadBlocklistFrom(blocklistFile))
+	require.NoError(t, err)
+	yankedVersions := make(chan *repository.Update, 1)
+	updater.RegisterBootedVersionYankedCallback(func(update *repository.Update) {
+		yankedVersions <- update
+	})
+
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+	select {
+	case booted := <-yankedVersions:
+		assert.Equal(t, "1.8.1", booted.Version.String())
+		assert.Equal(t, "Breaks the temperature sensor", booted.YankReason)
+	case <-time.After(time.Second):
+		t.Fatal("yanked booted version has not been reported")
+	}
+
+	// The blocklist file is read before every check
+	require.NoError(t, os.WriteFile(blocklistFile, nil, 0644))
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.3", update.Name)
+
+	// Invalid lines don't unblock the other entries
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("1.8.3 # bricks the display\n1.8.x.1\n"), 0644))
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+}
+
+func TestYankedMandatoryRelease(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	var updates []repository.Update
+	for _, version := range []string{"1.9.0", "1.10.0"} {
+		updates = append(updates, repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v" + version + "_update.bin"},
+			},
+		})
+	}
+	updates[0].Mandatory = true
+	updates[0].Yanked = true
+	repo.EXPECT().Updates(mock.Anything).Return(updates, nil)
+	expectBootedVersion(raucClient, "1.8.2")
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient))
+	require.NoError(t, err)
+
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+}
+
+func TestYankedMandatoryReleaseOnOtherChannel(t *testing.T) {
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+
+	var updates []repository.Update
+	for _, version := range []string{"1.9.0-nightly.1", "1.10.0"} {
+		updates = append(updates, repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v" + version + "_update.bin"},
+			},
+		})
+	}
+	// Devices on the stable channel never install the nightly, so it doesn't block them
+	updates[0].Mandatory = true
+	updates[0].Yanked = true
+	repo.EXPECT().Updates(mock.Anything).Return(updates, nil)
+	expectBootedVersion(raucClient, "1.8.2")
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient))
+	require.NoError(t, err)
+
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.10.0", update.Name)
+}
+
+func TestStagedRollout(t *testing.T) {
+	version := semver.New("1.8.2")
+	selected := 0
+	for i := 0; i < 1000; i++ {
+		deviceID := fmt.Sprintf("device-%d", i)
+		bucket := rolloutBucket(deviceID, version)
+		assert.Equal(t, bucket, rolloutBucket(deviceID, version))
+		if bucket < 5 {
+			selected++
+		}
+	}
+	assert.InDelta(t, 50, selected, 30)
+
+	repo := mocks.NewRepository(t)
+	raucClient := mocks.NewRaucDBUSClient(t)
+	percentage := 0
+	updates := []repository.Update{
+		{
+			Name:              "Penguin",
+			Version:           version,
+			ReleaseDate:       time.Now().Add(-72 * time.Hour),
+			RolloutPercentage: &percentage,
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+			},
+		},
+	}
+	repo.EXPECT().Updates(mock.Anything).Return(updates, nil)
+	expectBootedVersion(raucClient, "1.8.1")
+
+	deviceID := "cbpi-0042"
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), WithDeviceID(deviceID))
+	require.NoError(t, err)
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+
+	percentage = rolloutBucket(deviceID, version) + 1
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.NoError(t, err)
+
+	// The schedule has reached the second stage, which includes the device
+	updates[0].RolloutSchedule = []repository.RolloutStage{
+		{After: 0, Percentage: 0},
+		{After: 48 * time.Hour, Percentage: percentage},
+		{After: 96 * time.Hour, Percentage: 100},
+	}
+	percentage = 0
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.NoError(t, err)
+
+	updates[0].ReleaseDate = time.Now()
+	_, err = updater.CheckForUpdate(context.Background())
+	assert.ErrorIs(t, err, ErrNoSuitableUpdate)
+}
+
+type rejectingRepo struct {
+	updates  []repository.Update
+	rejected map[string]error
+}
+
+func (r *rejectingRepo) Updates(ctx context.Context) ([]repository.Update, error) {
+	return r.updates, nil
+}
+
+func (r *rejectingRepo) UpdateRejected(ctx context.Context, update *repository.Update, reason error) error {
+	r.rejected[update.Version.String()] = reason
+	return nil
+}
+
+func TestRejectUpdates(t *testing.T) {
+	raucClient := mocks.NewRaucDBUSClient(t)
+	newUpdate := func(version, board string) repository.Update {
+		return repository.Update{
+			Name:    version,
+			Version: semver.New(version),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-" + board + "_v" + version + "_update.bin"},
+			},
+		}
+	}
+	internal := newUpdate("1.8.5", "raspberrypi3-64")
+	internal.Channel = "internal"
+	percentage := 0
+	notRolledOut := newUpdate("1.8.6", "raspberrypi3-64")
+	notRolledOut.RolloutPercentage = &percentage
+	repo := &rejectingRepo{
+		updates: []repository.Update{
+			newUpdate("1.8.1", "raspberrypi3-64"), newUpdate("1.8.2", "raspberrypi3-64"),
+			newUpdate("1.8.3", "raspberrypi3-64"), newUpdate("1.8.4", "raspberrypi4-64"),
+			internal, notRolledOut,
+		},
+		rejected: make(map[string]error),
+	}
+	expectBootedVersion(raucClient, "1.8.2")
+
+	updater, err := NewUpdateManager(repo, WithRaucClient(raucClient), WithDeviceID("cbpi-0042"))
+	require.NoError(t, err)
+	update, err := updater.CheckForUpdate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.3", update.Name)
+
+	require.Len(t, repo.rejected, 4)
+	assert.EqualError(t, repo.rejected["1.8.1"], "newer version 1.8.2 is already installed")
+	assert.ErrorIs(t, repo.rejected["1.8.2"], repository.ErrAlreadyInstalled)
+	assert.EqualError(t, repo.rejected["1.8.4"], "no update bundle for compatible cbpifw-raspberrypi3-64")
+	assert.EqualError(t, repo.rejected["1.8.5"], "device is not subscribed to channel internal")
+}
@@ -0,0 +1,89 @@
+package raucgithub
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+)
+
+// WithMirrors tries to fetch bundles from the given base URLs before the locations provided by the repository,
+// i.e. from a cache in the local network. The asset name of the bundle is appended to the base URLs.
+func WithMirrors(baseURLs ...string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.mirrors = append(u.mirrors, baseURLs...)
+		return u
+	}
+}
+
+type bundleCandidate struct {
+	url    string
+	header http.Header
+	sha256 string
+}
+
+// bundleCandidates returns all locations of the bundle in the order they should be tried. The configured
+// mirrors come first, then the URL of the bundle and then the mirrors known to the repository.
+func (u *UpdateManager) bundleCandidates(bundle *repository.BundleLink) (candidates []bundleCandidate) {
+	seen := make(map[string]bool)
+	add := func(candidate bundleCandidate) {
+		if candidate.url == "" || seen[candidate.url] {
+			return
+		}
+		seen[candidate.url] = true
+		candidates = append(candidates, candidate)
+	}
+	if bundle.AssetName != "" {
+		for _, baseURL := range u.mirrors {
+			add(bundleCandidate{
+				url:    strings.TrimSuffix(baseURL, "/") + "/" + url.PathEscape(bundle.AssetName),
+				sha256: bundle.SHA256,
+			})
+		}
+	}
+	add(bundleCandidate{url: bundle.URL, header: bundle.Header, sha256: bundle.SHA256})
+	for _, mirror := range bundle.Mirrors {
+		add(bundleCandidate{url: mirror, sha256: bundle.SHA256})
+	}
+	return
+}
+
+// fetchError marks errors caused by the location of a bundle, so the bundle might still be installed from one
+// of its other locations
+type fetchError struct {
+	err error
+}
+
+func (e *fetchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+func isFetchError(err error) bool {
+	var fetchErr *fetchError
+	return errors.As(err, &fetchErr)
+}
+
+// raucBundleErrors identify errors of rauc which are caused by the bundle itself or the device, so the same
+// error would occur with every location of the bundle
+var raucBundleErrors = []string{"signature", "compatible", "no space"}
+
+// raucFetchError marks errors of rauc as fetch errors if rauc accessed the bundle via the network and the error
+// isn't caused by the bundle itself
+func raucFetchError(location string, err error) error {
+	if !isRemoteBundle(location) {
+		return err
+	}
+	msg := strings.ToLower(err.Error())
+	for _, bundleErr := range raucBundleErrors {
+		if strings.Contains(msg, bundleErr) {
+			return err
+		}
+	}
+	return &fetchError{err: err}
+}
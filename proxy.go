@@ -0,0 +1,183 @@
+package raucgithub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const proxyPathPrefix = "/bundles/"
+
+// headers which are passed through to rauc, so it can stream bundles via range requests
+var proxiedResponseHeaders = []string{
+	"Accept-Ranges",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+}
+
+var proxiedRequestHeaders = []string{
+	"Range",
+	"If-Range",
+}
+
+// StreamBundlesViaProxy lets rauc stream bundles through a proxy on localhost instead of downloading bundles
+// which need additional headers first. The proxy adds the headers, follows redirects and passes range requests
+// through. Only bundles which are currently installed can be requested from the proxy.
+func StreamBundlesViaProxy(listenAddr string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.proxy = newBundleProxy(listenAddr)
+		return u
+	}
+}
+
+type bundleProxy struct {
+	listenAddr string
+	client     *http.Client
+	logger     logrus.FieldLogger
+
+	lock     sync.Mutex
+	listener net.Listener
+	bundles  map[string]bundleCandidate
+}
+
+func newBundleProxy(listenAddr string) *bundleProxy {
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:0"
+	}
+	return &bundleProxy{
+		listenAddr: listenAddr,
+		client:     &http.Client{CheckRedirect: dropCredentialsOnRedirect},
+		logger:     logrus.WithField("component", "BundleProxy"),
+		bundles:    make(map[string]bundleCandidate),
+	}
+}
+
+// start starts listening if the proxy isn't running yet
+func (p *bundleProxy) start() error {
+	if p.listener != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", p.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start bundle proxy on %s: %w", p.listenAddr, err)
+	}
+	p.listener = listener
+	p.logger = p.logger.WithField("address", listener.Addr().String())
+	go func() {
+		if err := http.Serve(listener, p); err != nil && !errors.Is(err, net.ErrClosed) {
+			p.logger.WithError(err).Error("bundle proxy stopped")
+		}
+	}()
+	return nil
+}
+
+// allow makes the bundle available via the proxy and returns the URL rauc should use. The bundle can
+// be requested until revoke is called.
+func (p *bundleProxy) allow(candidate bundleCandidate) (proxyURL string, revoke func(), err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.start(); err != nil {
+		return "", nil, err
+	}
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", nil, fmt.Errorf("failed to generate proxy token: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+	p.bundles[token] = candidate
+
+	proxyURL = "http://" + p.listener.Addr().String() + proxyPathPrefix + token
+	if u, err := url.Parse(candidate.url); err == nil {
+		if _, fileName := path.Split(u.Path); fileName != "" {
+			proxyURL = proxyURL + "/" + fileName
+		}
+	}
+	revoke = func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		delete(p.bundles, token)
+	}
+	return proxyURL, revoke, nil
+}
+
+func (p *bundleProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, proxyPathPrefix), "/")
+	p.lock.Lock()
+	candidate, exists := p.bundles[token]
+	p.lock.Unlock()
+	if !strings.HasPrefix(r.URL.Path, proxyPathPrefix) || !exists {
+		http.NotFound(w, r)
+		return
+	}
+	logger := p.logger.WithFields(logrus.Fields{"bundleURL": candidate.url, "range": r.Header.Get("Range")})
+
+	resp, err := p.fetch(r.Context(), r, candidate)
+	if err != nil {
+		logger.WithError(err).Error("failed to fetch bundle")
+		http.Error(w, "failed to fetch bundle", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range proxiedResponseHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.WithError(err).Warn("failed to stream bundle")
+	}
+}
+
+// dropCredentialsOnRedirect removes credentials if a redirect points to another host, like the object storage
+// GitHub uses for assets. Presigned URLs are rejected if credentials are sent along. The http client does the same
+// already, but ignores the port.
+func dropCredentialsOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+		req.Header.Del("PRIVATE-TOKEN")
+		req.Header.Del("Cookie")
+	}
+	return nil
+}
+
+// fetch requests the bundle from upstream and follows redirects
+func (p *bundleProxy) fetch(ctx context.Context, r *http.Request, candidate bundleCandidate) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, r.Method, candidate.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range candidate.header {
+		req.Header[key] = values
+	}
+	for _, header := range proxiedRequestHeaders {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	return p.client.Do(req)
+}
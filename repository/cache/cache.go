@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultDir = "/var/lib/raucgithub"
+	cacheFile  = "updates.json"
+)
+
+type cacheContent struct {
+	Updated time.Time           `json:"updated"`
+	Updates []repository.Update `json:"updates"`
+}
+
+// CachedRepo stores the last successful result of a repository on disk and serves it if the repository
+// can't be reached, i.e. on flaky cellular connections. Updates verified by TUF are never served from the cache,
+// so it belongs below the TUF verification.
+type CachedRepo struct {
+	repository.Wrapper
+	repo   repository.Repository
+	path   string
+	logger logrus.FieldLogger
+	now    func() time.Time
+
+	lock      sync.Mutex
+	updated   time.Time
+	fromCache bool
+}
+
+// New wraps repo and stores its updates in dir
+func New(repo repository.Repository, dir string) (*CachedRepo, error) {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, cacheFile)
+	return &CachedRepo{
+		Wrapper: repository.Wrap(repo),
+		repo:    repo,
+		path:    path,
+		logger:  logrus.WithFields(logrus.Fields{"repotype": "cache", "path": path}),
+		now:     time.Now,
+	}, nil
+}
+
+func (c *CachedRepo) Updates(ctx context.Context) ([]repository.Update, error) {
+	updates, err := c.repo.Updates(ctx)
+	if err == nil || repository.IsPartial(err) {
+		now := c.now()
+		if err != nil {
+			// Storing the result would hide the updates of the failed sources until they are reachable again
+			c.logger.WithError(err).Warn("repository returned incomplete updates, keeping the cached updates")
+		} else if storeErr := c.store(now, updates); storeErr != nil {
+			c.logger.WithError(storeErr).Warn("failed to store updates in cache")
+		}
+		c.lock.Lock()
+		c.updated = now
+		c.fromCache = false
+		c.lock.Unlock()
+		return updates, err
+	}
+	if repository.IsUntrusted(err) {
+		// Falling back to older metadata would make rollback and freeze attacks possible
+		return nil, err
+	}
+
+	content, loadErr := c.load()
+	if loadErr != nil {
+		if !errors.Is(loadErr, os.ErrNotExist) {
+			c.logger.WithError(loadErr).Warn("failed to load cached updates")
+		}
+		return nil, err
+	}
+	for _, update := range content.Updates {
+		if update.Verified {
+			// The cache can't tell whether the metadata of verified updates has expired in the meantime,
+			// serving them would defeat the protection against freeze attacks
+			c.logger.WithError(err).Warn("repository unreachable, cached updates have been verified and are not used")
+			return nil, err
+		}
+	}
+	c.logger.WithError(err).WithField("age", c.now().Sub(content.Updated).String()).
+		Warn("repository unreachable, using cached updates")
+	c.lock.Lock()
+	c.updated = content.Updated
+	c.fromCache = true
+	c.lock.Unlock()
+	return content.Updates, nil
+}
+
+// Age returns how old the updates returned by the last call to Updates are and whether they were
+// served from the cache
+func (c *CachedRepo) Age() (age time.Duration, fromCache bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.updated.IsZero() {
+		return 0, false
+	}
+	return c.now().Sub(c.updated), c.fromCache
+}
+
+// RepositoryStatus adds the age of the updates to the status of the cached repository
+func (c *CachedRepo) RepositoryStatus() map[string]string {
+	status := make(map[string]string)
+	if reporter, ok := c.repo.(repository.StatusReporter); ok {
+		for key, value := range reporter.RepositoryStatus() {
+			status[key] = value
+		}
+	}
+	c.lock.Lock()
+	updated, fromCache := c.updated, c.fromCache
+	c.lock.Unlock()
+	if !updated.IsZero() {
+		status["updatesAge"] = c.now().Sub(updated).Round(time.Second).String()
+		status["fromCache"] = strconv.FormatBool(fromCache)
+	}
+	return status
+}
+
+// store writes the cache atomically, so a power loss doesn't leave a broken cache behind. Headers of bundles
+// aren't stored as they contain tokens, the file is still only readable by us as bundle URLs can be presigned.
+func (c *CachedRepo) store(updated time.Time, updates []repository.Update) error {
+	stored := make([]repository.Update, len(updates))
+	for i, update := range updates {
+		update.Bundles = make([]*repository.BundleLink, len(updates[i].Bundles))
+		for j, bundle := range updates[i].Bundles {
+			withoutHeader := *bundle
+			withoutHeader.Header = nil
+			update.Bundles[j] = &withoutHeader
+		}
+		stored[i] = update
+	}
+	data, err := json.Marshal(cacheContent{Updated: updated, Updates: stored})
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(c.path), cacheFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), c.path)
+}
+
+func (c *CachedRepo) load() (*cacheContent, error) {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	content := &cacheContent{}
+	if err := json.Unmarshal(data, content); err != nil {
+		return nil, fmt.Errorf("invalid cache file: %w", err)
+	}
+	return content, nil
+}
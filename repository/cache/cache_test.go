@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/mocks"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeCachedUpdatesWhenOffline(t *testing.T) {
+	dir := t.TempDir()
+	upstream := mocks.NewRepository(t)
+	upstream.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:        "Penguin",
+			Version:     semver.New("1.8.2"),
+			ReleaseDate: time.Date(2023, 1, 20, 10, 0, 0, 0, time.UTC),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin", Size: 1024},
+			},
+		},
+	}, nil).Once()
+
+	repo, err := New(upstream, dir)
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	_, fromCache := repo.Age()
+	assert.False(t, fromCache)
+
+	// Simulate a restart of the daemon without network
+	offline := mocks.NewRepository(t)
+	offline.EXPECT().Updates(mock.Anything).Return(nil, errors.New("network unreachable"))
+	repo, err = New(offline, dir)
+	require.NoError(t, err)
+	later := time.Now().Add(2 * time.Hour)
+	repo.now = func() time.Time { return later }
+
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, "Penguin", updates[0].Name)
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	assert.Equal(t, "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin", updates[0].Bundles[0].URL)
+
+	age, fromCache := repo.Age()
+	assert.True(t, fromCache)
+	assert.InDelta(t, (2 * time.Hour).Seconds(), age.Seconds(), 5)
+	assert.Equal(t, "true", repo.RepositoryStatus()["fromCache"])
+}
+
+func TestKeepCacheOnIncompleteOrUntrustedUpdates(t *testing.T) {
+	dir := t.TempDir()
+	penguin := repository.Update{Name: "Penguin", Version: semver.New("1.8.2")}
+	upstream := mocks.NewRepository(t)
+	upstream.EXPECT().Updates(mock.Anything).Return([]repository.Update{penguin}, nil).Once()
+	repo, err := New(upstream, dir)
+	require.NoError(t, err)
+	_, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+
+	// Only some sources answered, the result is used but must not replace the cache
+	partial := &repository.PartialError{Errs: []error{errors.New("github: network unreachable")}}
+	upstream.EXPECT().Updates(mock.Anything).Return(nil, partial).Once()
+	updates, err := repo.Updates(context.Background())
+	assert.ErrorIs(t, err, partial)
+	assert.Empty(t, updates)
+
+	upstream.EXPECT().Updates(mock.Anything).Return(nil, errors.New("network unreachable")).Once()
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, "Penguin", updates[0].Name)
+
+	// Metadata which can't be verified must not be replaced with older metadata
+	untrusted := &repository.UntrustedError{Err: errors.New("timestamp.json has expired")}
+	upstream.EXPECT().Updates(mock.Anything).Return(nil, untrusted).Once()
+	_, err = repo.Updates(context.Background())
+	assert.ErrorIs(t, err, untrusted)
+	upstream.EXPECT().Updates(mock.Anything).Return(nil, repository.ErrInvalidSignature).Once()
+	_, err = repo.Updates(context.Background())
+	assert.ErrorIs(t, err, repository.ErrInvalidSignature)
+}
+
+func TestNoCacheAvailable(t *testing.T) {
+	offline := mocks.NewRepository(t)
+	offline.EXPECT().Updates(mock.Anything).Return(nil, errors.New("network unreachable"))
+	repo, err := New(offline, t.TempDir())
+	require.NoError(t, err)
+	_, err = repo.Updates(context.Background())
+	assert.EqualError(t, err, "network unreachable")
+}
+
+func TestCacheRolloutSchedule(t *testing.T) {
+	dir := t.TempDir()
+	percentage := 10
+	schedule := []repository.RolloutStage{
+		{After: 24 * time.Hour, Percentage: 50},
+		{After: 72 * time.Hour, Percentage: 100},
+	}
+	upstream := mocks.NewRepository(t)
+	upstream.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:              "Penguin",
+			Version:           semver.New("1.8.2"),
+			RolloutPercentage: &percentage,
+			RolloutSchedule:   schedule,
+		},
+	}, nil).Once()
+	repo, err := New(upstream, dir)
+	require.NoError(t, err)
+	_, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+
+	offline := mocks.NewRepository(t)
+	offline.EXPECT().Updates(mock.Anything).Return(nil, errors.New("network unreachable"))
+	repo, err = New(offline, dir)
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, 10, *updates[0].RolloutPercentage)
+	assert.Equal(t, schedule, updates[0].RolloutSchedule)
+}
+
+func TestCacheWithoutCredentialsAndVerifiedUpdates(t *testing.T) {
+	dir := t.TempDir()
+	upstream := mocks.NewRepository(t)
+	upstream.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:    "Penguin",
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{
+					URL:    "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+					Header: http.Header{"Authorization": {"token secret"}},
+				},
+			},
+		},
+	}, nil).Once()
+	repo, err := New(upstream, dir)
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "token secret", updates[0].Bundles[0].Header.Get("Authorization"))
+	data, err := os.ReadFile(filepath.Join(dir, cacheFile))
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret")
+
+	// The cache can't check the expiry of the metadata verified updates were checked against
+	verified := mocks.NewRepository(t)
+	verified.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{Name: "Penguin", Version: semver.New("1.8.2"), Verified: true},
+	}, nil).Once()
+	repo, err = New(verified, dir)
+	require.NoError(t, err)
+	_, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+
+	offline := mocks.NewRepository(t)
+	offline.EXPECT().Updates(mock.Anything).Return(nil, errors.New("network unreachable"))
+	repo, err = New(offline, dir)
+	require.NoError(t, err)
+	_, err = repo.Updates(context.Background())
+	assert.EqualError(t, err, "network unreachable")
+}
@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+const (
+	// StableChannel is the channel of all regular releases
+	StableChannel = "stable"
+	// PrereleaseChannel is used for prereleases whose version doesn't name a channel
+	PrereleaseChannel = "beta"
+)
+
+// ChannelOf returns the channel the update is published on. Repositories can set the channel explicitly, i.e.
+// from release metadata. Otherwise it is taken from the pre-release part of the version, which repositories
+// derive from tags or asset names, so 1.9.0-nightly.20230120 is published on nightly and 1.9.0-beta2 on beta.
+func ChannelOf(update *Update) string {
+	if update.Channel != "" {
+		return strings.ToLower(update.Channel)
+	}
+	if channel := ChannelFromVersion(update.Version); channel != "" {
+		return channel
+	}
+	if update.Prerelease {
+		return PrereleaseChannel
+	}
+	return StableChannel
+}
+
+// ChannelFromVersion returns the channel named in the pre-release part of the version, or an empty string if
+// the version has no pre-release part or it doesn't start with a name
+func ChannelFromVersion(version *semver.Version) string {
+	if version == nil || version.PreRelease == "" {
+		return ""
+	}
+	identifier := strings.SplitN(string(version.PreRelease), ".", 2)[0]
+	return strings.ToLower(strings.TrimRight(identifier, "0123456789-"))
+}
@@ -0,0 +1,100 @@
+package checksum
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// ChecksumRepo attaches the hashes of checksum files like SHA256SUMS, which are published next to the bundles
+// of a release, to the bundles of the wrapped repository. Published checksum files are not expected to change,
+// so each one is only downloaded once.
+type ChecksumRepo struct {
+	repository.Wrapper
+	repo   repository.Repository
+	client *http.Client
+	logger logrus.FieldLogger
+
+	lock sync.Mutex
+	// checksums holds the parsed checksum files by URL
+	checksums map[string]map[string]string
+}
+
+func New(repo repository.Repository) *ChecksumRepo {
+	return &ChecksumRepo{
+		Wrapper:   repository.Wrap(repo),
+		repo:      repo,
+		client:    http.DefaultClient,
+		logger:    logrus.WithField("repotype", "checksum"),
+		checksums: make(map[string]map[string]string),
+	}
+}
+
+// Updates attaches the checksums to the updates of the wrapped repository. Bundles which already have a hash,
+// i.e. from a manifest or TUF metadata, keep it. Verified updates are left alone.
+func (c *ChecksumRepo) Updates(ctx context.Context) ([]repository.Update, error) {
+	updates, err := c.repo.Updates(ctx)
+	if err != nil && !repository.IsPartial(err) {
+		return nil, err
+	}
+	for i := range updates {
+		if updates[i].Verified {
+			// Hashes of unsigned checksum files must not end up in verified updates
+			continue
+		}
+		c.attach(ctx, &updates[i])
+	}
+	return updates, err
+}
+
+func (c *ChecksumRepo) attach(ctx context.Context, update *repository.Update) {
+	checksums := make(map[string]string)
+	for _, bundle := range update.Bundles {
+		if !repository.IsChecksumAsset(repository.AssetName(bundle)) {
+			continue
+		}
+		sums, err := c.load(ctx, bundle)
+		if err != nil {
+			c.logger.WithError(err).WithFields(logrus.Fields{
+				"updateVersion": update.Version.String(),
+				"checksumURL":   bundle.URL,
+			}).Warn("failed to load checksum file")
+			continue
+		}
+		for name, hash := range sums {
+			checksums[name] = hash
+		}
+	}
+	if len(checksums) == 0 {
+		return
+	}
+	// The bundles might be shared with the wrapped repository, i.e. if it keeps its last result
+	update.Bundles = append([]*repository.BundleLink{}, update.Bundles...)
+	for i, bundle := range update.Bundles {
+		if hash, exists := checksums[repository.AssetName(bundle)]; exists && bundle.SHA256 == "" {
+			withHash := *bundle
+			withHash.SHA256 = hash
+			update.Bundles[i] = &withHash
+		}
+	}
+}
+
+func (c *ChecksumRepo) load(ctx context.Context, checksumAsset *repository.BundleLink) (map[string]string, error) {
+	c.lock.Lock()
+	sums, exists := c.checksums[checksumAsset.URL]
+	c.lock.Unlock()
+	if exists {
+		return sums, nil
+	}
+	sums, err := repository.FetchChecksums(ctx, c.client, checksumAsset)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.checksums[checksumAsset.URL] = sums
+	c.lock.Unlock()
+	return sums, nil
+}
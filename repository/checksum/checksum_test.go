@@ -0,0 +1,77 @@
+package checksum
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/mocks"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	pi3Hash = "8c4cc8d5e5dbd1a6c7ec8b0b3c35f2b4d6a1ee8b1bd4e0d2a9f0c8f2a07a4c11"
+	pi4Hash = "3f0e2a1c9b8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"
+)
+
+func TestAttachChecksums(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(pi3Hash + "  cbpifw-raspberrypi3-64_v1.8.2_update.bin\n" +
+			pi4Hash + " *cbpifw-raspberrypi4-64_v1.8.2_update.bin\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	upstream := mocks.NewRepository(t)
+	upstream.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+				{URL: "https://example.com/cbpifw-raspberrypi4-64_v1.8.2_update.bin", SHA256: "abcd"},
+				{URL: srv.URL + "/SHA256SUMS", AssetName: "SHA256SUMS"},
+			},
+		},
+	}, nil)
+
+	repo := New(upstream)
+	for i := 0; i < 2; i++ {
+		updates, err := repo.Updates(context.Background())
+		require.NoError(t, err)
+		require.Len(t, updates, 1)
+		assert.Equal(t, pi3Hash, updates[0].Bundles[0].SHA256)
+		// Hashes from the repository metadata are kept
+		assert.Equal(t, "abcd", updates[0].Bundles[1].SHA256)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+}
+
+func TestVerifiedUpdatesAreLeftAlone(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(pi3Hash + "  cbpifw-raspberrypi3-64_v1.8.2_update.bin\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	upstream := mocks.NewRepository(t)
+	upstream.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Version:  semver.New("1.8.2"),
+			Verified: true,
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+				{URL: srv.URL + "/SHA256SUMS", AssetName: "SHA256SUMS"},
+			},
+		},
+	}, nil)
+
+	updates, err := New(upstream).Updates(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, updates[0].Bundles[0].SHA256)
+}
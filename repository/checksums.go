@@ -0,0 +1,200 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxChecksumFileSize limits how much of a checksum file is read, they are expected to be tiny
+const maxChecksumFileSize = 1024 * 1024
+
+var (
+	// sha256sum writes lines like "<hash>  <name>" or "<hash> *<name>" in binary mode
+	checksumLineRegex = regexp.MustCompile(`^([0-9a-fA-F]{64})(?:\s+\*?(.+))?$`)
+	// BSD style checksums look like "SHA256 (<name>) = <hash>"
+	bsdChecksumLineRegex = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+)
+
+// IsChecksumAsset reports whether the release asset contains SHA256 checksums of other assets
+func IsChecksumAsset(assetName string) bool {
+	lower := strings.ToLower(assetName)
+	return lower == "sha256sums" || lower == "sha256sums.txt" || strings.HasSuffix(lower, ".sha256")
+}
+
+// ParseChecksums parses the content of a checksum file and returns the hex encoded hashes by file name.
+// Files like bundle.bin.sha256 may only contain the hash, which then belongs to the file named like the
+// checksum file without the .sha256 suffix.
+func ParseChecksums(data []byte, checksumAssetName string) map[string]string {
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var hash, name string
+		if submatches := checksumLineRegex.FindStringSubmatch(line); submatches != nil {
+			hash, name = submatches[1], submatches[2]
+		} else if submatches := bsdChecksumLineRegex.FindStringSubmatch(line); submatches != nil {
+			name, hash = submatches[1], submatches[2]
+		} else {
+			continue
+		}
+		if name == "" {
+			if !strings.HasSuffix(strings.ToLower(checksumAssetName), ".sha256") {
+				continue
+			}
+			name = checksumAssetName[:len(checksumAssetName)-len(".sha256")]
+		}
+		checksums[path.Base(strings.TrimSpace(name))] = strings.ToLower(hash)
+	}
+	return checksums
+}
+
+var (
+	ErrMissingSignature = errors.New("release metadata is not signed")
+	ErrInvalidSignature = errors.New("invalid signature of release metadata")
+)
+
+// SignatureVerifier verifies detached signatures over release metadata like checksum files or manifests
+type SignatureVerifier interface {
+	Verify(message, signature []byte) error
+}
+
+// SignatureNames returns the names detached signatures of the file are expected under
+func SignatureNames(name string) []string {
+	return []string{name + ".minisig", name + ".sig"}
+}
+
+// FetchChecksums downloads the checksum file and returns the hex encoded hashes by file name
+func FetchChecksums(ctx context.Context, client *http.Client, checksumAsset *BundleLink) (map[string]string, error) {
+	data, err := fetchAsset(ctx, client, checksumAsset)
+	if err != nil {
+		return nil, err
+	}
+	return ParseChecksums(data, AssetName(checksumAsset)), nil
+}
+
+// AttachChecksums downloads all checksum files among the bundles of the update and attaches the hashes to
+// the bundles they describe. Bundles which already have a hash keep it. As this downloads files, it should
+// only be used for updates which are about to be installed.
+func AttachChecksums(ctx context.Context, client *http.Client, update *Update) error {
+	return attachChecksums(ctx, client, update, nil)
+}
+
+// AttachVerifiedChecksums works like AttachChecksums, but only uses checksum files with a valid detached
+// signature. Hashes which are already attached are discarded, as they are not covered by the signature, unless
+// the repository verified the update itself. ErrMissingSignature is returned if the update has no signed checksum
+// file.
+func AttachVerifiedChecksums(ctx context.Context, client *http.Client, update *Update, verifier SignatureVerifier) error {
+	if update.Verified {
+		return nil
+	}
+	for _, bundle := range update.Bundles {
+		bundle.SHA256 = ""
+	}
+	return attachChecksums(ctx, client, update, verifier)
+}
+
+func attachChecksums(ctx context.Context, client *http.Client, update *Update, verifier SignatureVerifier) error {
+	assets := make(map[string]*BundleLink)
+	for _, bundle := range update.Bundles {
+		assets[AssetName(bundle)] = bundle
+	}
+	checksums := make(map[string]string)
+	var fetchErr error
+	for _, bundle := range update.Bundles {
+		if !IsChecksumAsset(bundle.AssetName) {
+			continue
+		}
+		data, err := fetchAsset(ctx, client, bundle)
+		if err != nil {
+			fetchErr = fmt.Errorf("failed to load checksum file %s: %w", bundle.AssetName, err)
+			continue
+		}
+		if verifier != nil {
+			if err := verifyAsset(ctx, client, assets, bundle.AssetName, data, verifier); err != nil {
+				return err
+			}
+		}
+		for name, hash := range ParseChecksums(data, bundle.AssetName) {
+			checksums[name] = hash
+		}
+	}
+	if verifier != nil && len(checksums) == 0 {
+		if fetchErr != nil {
+			return fetchErr
+		}
+		return fmt.Errorf("%w: no checksum file found", ErrMissingSignature)
+	}
+	for _, bundle := range update.Bundles {
+		if hash, exists := checksums[AssetName(bundle)]; exists && bundle.SHA256 == "" {
+			bundle.SHA256 = hash
+		}
+	}
+	return fetchErr
+}
+
+func verifyAsset(ctx context.Context, client *http.Client, assets map[string]*BundleLink, name string, data []byte, verifier SignatureVerifier) error {
+	for _, signatureName := range SignatureNames(name) {
+		signatureAsset, exists := assets[signatureName]
+		if !exists {
+			continue
+		}
+		signature, err := fetchAsset(ctx, client, signatureAsset)
+		if err != nil {
+			return fmt.Errorf("failed to load signature %s: %w", signatureName, err)
+		}
+		if err := verifier.Verify(data, signature); err != nil {
+			return fmt.Errorf("failed to verify %s: %w", name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s has no signature", ErrMissingSignature, name)
+}
+
+// AssetName returns the name of the bundle, which is the file name of the URL if the repository doesn't know it
+func AssetName(bundle *BundleLink) string {
+	if bundle.AssetName != "" {
+		return bundle.AssetName
+	}
+	if u, err := url.Parse(bundle.URL); err == nil {
+		return path.Base(u.Path)
+	}
+	return ""
+}
+
+// fetchAsset downloads a small release asset like a checksum file or a signature
+func fetchAsset(ctx context.Context, client *http.Client, bundle *BundleLink) ([]byte, error) {
+	if u, err := url.Parse(bundle.URL); err == nil && u.Scheme == "file" {
+		file, err := os.Open(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(io.LimitReader(file, maxChecksumFileSize))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bundle.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range bundle.Header {
+		req.Header[key] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxChecksumFileSize))
+}
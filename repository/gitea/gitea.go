@@ -0,0 +1,154 @@
+package gitea
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const releasesPerPage = 50
+
+type release struct {
+	TagName     string    `json:"tag_name"`
+	Name        string    `json:"name"`
+	Body        string    `json:"body"`
+	Draft       bool      `json:"draft"`
+	Prerelease  bool      `json:"prerelease"`
+	PublishedAt time.Time `json:"published_at"`
+	Assets      []asset   `json:"assets"`
+}
+
+type asset struct {
+	Name               string `json:"name"`
+	Size               int64  `json:"size"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+// GiteaRepo queries releases from Gitea or Forgejo instances, which share the same API
+type GiteaRepo struct {
+	client  *http.Client
+	baseURL string
+	owner   string
+	repo    string
+	token   string
+	logger  logrus.FieldLogger
+}
+
+func init() {
+	repository.RegisterBuilder("gitea", New)
+}
+
+func New(conf *viper.Viper) (repository.Repository, error) {
+	baseURL := conf.GetString("baseURL")
+	owner := conf.GetString("owner")
+	repo := conf.GetString("repo")
+	token := conf.GetString("token")
+	return NewRepo(baseURL, owner, repo, token)
+}
+
+// NewRepo creates a repository for the releases of owner/repo on the Gitea or Forgejo instance at baseURL.
+// The token is optional and only necessary for private repositories.
+func NewRepo(baseURL, owner, repo, token string) (*GiteaRepo, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("no gitea base URL specified")
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid gitea base URL %s: %w", baseURL, err)
+	}
+	if owner == "" || repo == "" {
+		return nil, fmt.Errorf("gitea owner and repo need to be specified")
+	}
+	return &GiteaRepo{
+		client:  http.DefaultClient,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		owner:   owner,
+		repo:    repo,
+		token:   token,
+		logger:  logrus.WithFields(logrus.Fields{"repotype": "gitea", "baseURL": baseURL, "owner": owner, "repo": repo}),
+	}, nil
+}
+
+func (g *GiteaRepo) releasesURL(page int) string {
+	return fmt.Sprintf("%s/api/v1/repos/%s/%s/releases?limit=%d&page=%d", g.baseURL, url.PathEscape(g.owner),
+		url.PathEscape(g.repo), releasesPerPage, page)
+}
+
+// releases returns one page of releases and whether the Link header announces a next page
+func (g *GiteaRepo) releases(ctx context.Context, page int) (releases []release, more bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.releasesURL(page), nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create request for gitea repo %s/%s: %w", g.owner, g.repo, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if g.token != "" {
+		req.Header.Set("Authorization", "token "+g.token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to query gitea repo %s/%s: %w", g.owner, g.repo, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("failed to query gitea repo %s/%s: unexpected status %s", g.owner, g.repo, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return nil, false, fmt.Errorf("failed to decode releases of gitea repo %s/%s: %w", g.owner, g.repo, err)
+	}
+	return releases, strings.Contains(resp.Header.Get("Link"), `rel="next"`), nil
+}
+
+func (g *GiteaRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	logger := g.logger
+	for page, more := 1, true; more; page++ {
+		var releases []release
+		releases, more, err = g.releases(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, release := range releases {
+			if release.Draft {
+				continue
+			}
+			version, err := repository.VersionFromTag(release.TagName)
+			if err != nil {
+				logger.WithError(err).WithField("tagName", release.TagName).
+					Error("release can't be used because the tag name is not a semver version")
+				continue
+			}
+			update := repository.Update{
+				Version:     version,
+				ReleaseDate: release.PublishedAt,
+				Name:        release.Name,
+				Prerelease:  release.Prerelease,
+			}
+			if err := update.SetReleaseNotes(release.Body); err != nil {
+				logger.WithError(err).WithField("tagName", release.TagName).Warn("ignoring invalid release metadata")
+			}
+
+			for _, asset := range release.Assets {
+				bundle := repository.BundleLink{
+					URL:       asset.BrowserDownloadURL,
+					Size:      asset.Size,
+					AssetName: asset.Name,
+				}
+				if g.token != "" && strings.HasPrefix(bundle.URL, g.baseURL+"/") {
+					// Attachments of private repositories need the token as well, other hosts must not see it
+					bundle.Header = http.Header{}
+					bundle.Header.Set("Authorization", "token "+g.token)
+				}
+				update.Bundles = append(update.Bundles, &bundle)
+			}
+
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
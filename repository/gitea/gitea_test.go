@@ -0,0 +1,105 @@
+package gitea
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const releasesResponse = `[
+	{
+		"tag_name": "v1.8.2",
+		"name": "Penguin",
+		"body": "Some notes",
+		"draft": false,
+		"prerelease": false,
+		"published_at": "2023-01-20T10:00:00Z",
+		"assets": [
+			{
+				"name": "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				"size": 1024,
+				"browser_download_url": "https://forgejo.example.com/factory/firmware/releases/download/v1.8.2/cbpifw-raspberrypi3-64_v1.8.2_update.bin"
+			}
+		]
+	},
+	{
+		"tag_name": "v1.9.0",
+		"name": "Draft",
+		"draft": true
+	},
+	{
+		"tag_name": "v1.9.0-beta1",
+		"name": "Walrus",
+		"prerelease": true,
+		"published_at": "2023-02-20T10:00:00Z"
+	}
+]`
+
+func TestQueryingReleases(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/repos/factory/firmware/releases", r.URL.Path)
+		assert.Equal(t, "token secret", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(releasesResponse))
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo(srv.URL, "factory", "firmware", "secret")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	assert.Equal(t, "Penguin", updates[0].Name)
+	assert.Equal(t, "Some notes", updates[0].Notes)
+	require.Len(t, updates[0].Bundles, 1)
+	assert.Equal(t, "cbpifw-raspberrypi3-64_v1.8.2_update.bin", updates[0].Bundles[0].AssetName)
+	assert.EqualValues(t, 1024, updates[0].Bundles[0].Size)
+
+	assert.Equal(t, "1.9.0-beta1", updates[1].Version.String())
+	assert.True(t, updates[1].Prerelease)
+}
+
+func TestNewRepoRequiresBaseURL(t *testing.T) {
+	_, err := NewRepo("", "factory", "firmware", "")
+	assert.Error(t, err)
+}
+
+func TestWalkAllPagesWithToken(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token secret", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 2 {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?limit=50&page=2>; rel="next"`, srv.URL, r.URL.Path))
+		}
+		fmt.Fprintf(w, `[{
+			"tag_name": "v1.%d.0",
+			"assets": [
+				{"name": "local.raucb", "browser_download_url": "%s/factory/firmware/releases/download/v1.%d.0/local.raucb"},
+				{"name": "mirror.raucb", "browser_download_url": "https://mirror.example.com/v1.%d.0/mirror.raucb"}
+			]
+		}]`, page, srv.URL, page, page)
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo(srv.URL, "factory", "firmware", "secret")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+	assert.Equal(t, "1.1.0", updates[0].Version.String())
+	assert.Equal(t, "1.2.0", updates[1].Version.String())
+
+	require.Len(t, updates[1].Bundles, 2)
+	assert.Equal(t, "token secret", updates[1].Bundles[0].Header.Get("Authorization"))
+	assert.Nil(t, updates[1].Bundles[1].Header, "token must not be sent to other hosts")
+}
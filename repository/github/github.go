@@ -2,8 +2,14 @@ package github
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-semver/semver"
 	"github.com/dereulenspiegel/raucgithub/repository"
@@ -13,67 +19,350 @@ import (
 )
 
 type GithubRepo struct {
-	client *github.Client
-	owner  string
-	repo   string
-	logger logrus.FieldLogger
+	client      *github.Client
+	owner       string
+	repo        string
+	logger      logrus.FieldLogger
+	token       string
+	baseURL     string
+	useAssetAPI *bool
+	maxReleases int
+	tagPattern  *repository.TagPattern
+
+	transport *conditionalTransport
+
+	privateLock sync.Mutex
+	private     *bool
+
+	statsLock   sync.Mutex
+	lastScan    ScanStats
+	lastUpdates []repository.Update
+}
+
+const (
+	releasesPerPage    = 100
+	defaultMaxReleases = 500
+)
+
+type Option func(*GithubRepo) *GithubRepo
+
+// WithToken authenticates all requests with the given access token. This is necessary for private
+// repositories and raises the rate limit considerably.
+func WithToken(token string) Option {
+	return func(g *GithubRepo) *GithubRepo {
+		g.token = token
+		return g
+	}
+}
+
+// WithEnterpriseURL queries a GitHub Enterprise Server instead of github.com
+func WithEnterpriseURL(baseURL string) Option {
+	return func(g *GithubRepo) *GithubRepo {
+		g.baseURL = baseURL
+		return g
+	}
+}
+
+// WithMaxReleases limits how many releases are scanned, starting with the newest. A limit of 0 scans all releases.
+func WithMaxReleases(maxReleases int) Option {
+	return func(g *GithubRepo) *GithubRepo {
+		g.maxReleases = maxReleases
+		return g
+	}
+}
+
+// WithTagPattern only uses releases whose tag matches the pattern and extracts the version according to it.
+// Releases with other tags are skipped silently, so firmware releases can live in a monorepo.
+func WithTagPattern(pattern *repository.TagPattern) Option {
+	return func(g *GithubRepo) *GithubRepo {
+		g.tagPattern = pattern
+		return g
+	}
+}
+
+// UseAssetAPI downloads assets via the API asset endpoint instead of the browser download URL. Unless
+// configured, this is only done for private repositories if a token is used, as browser download URLs of
+// private repositories are not accessible with a token. Bundles downloaded via the API can't be streamed.
+func UseAssetAPI(enabled bool) Option {
+	return func(g *GithubRepo) *GithubRepo {
+		g.useAssetAPI = &enabled
+		return g
+	}
+}
+
+func init() {
+	repository.RegisterBuilder("github", New)
 }
 
 func New(conf *viper.Viper) (repository.Repository, error) {
 	owner := conf.GetString("owner")
 	repo := conf.GetString("repo")
-	return NewRepo(owner, repo)
+	token, err := tokenFromConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	opts := []Option{WithToken(token)}
+	if baseURL := conf.GetString("baseURL"); baseURL != "" {
+		opts = append(opts, WithEnterpriseURL(baseURL))
+	}
+	if conf.IsSet("maxReleases") {
+		opts = append(opts, WithMaxReleases(conf.GetInt("maxReleases")))
+	}
+	if tagPattern := conf.GetString("tagPattern"); tagPattern != "" {
+		pattern, err := repository.NewTagPattern(tagPattern)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithTagPattern(pattern))
+	}
+	if conf.IsSet("useAssetAPI") {
+		opts = append(opts, UseAssetAPI(conf.GetBool("useAssetAPI")))
+	}
+	return NewRepo(owner, repo, opts...)
 }
 
-func NewRepo(owner, repo string) (*GithubRepo, error) {
-	githubClient := github.NewClient(nil)
-	return &GithubRepo{
-		client: githubClient,
-		owner:  owner,
-		repo:   repo,
-		logger: logrus.WithFields(logrus.Fields{"repotype": "github", "owner": owner, "repo": repo}),
-	}, nil
+// tokenFromConfig reads the access token from the configuration, a token file or the environment
+func tokenFromConfig(conf *viper.Viper) (string, error) {
+	if token := conf.GetString("token"); token != "" {
+		return token, nil
+	}
+	if tokenFile := conf.GetString("tokenFile"); tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read github token from %s: %w", tokenFile, err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	if token := os.Getenv("RAUCGITHUB_GITHUB_TOKEN"); token != "" {
+		return token, nil
+	}
+	return os.Getenv("GITHUB_TOKEN"), nil
 }
 
-func (g *GithubRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
-	logger := g.logger
-	releases, _, err := g.client.Repositories.ListReleases(ctx, g.owner, g.repo, &github.ListOptions{
-		PerPage: 50,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to query github repo %s/%s: %w", g.owner, g.repo, err)
+func NewRepo(owner, repo string, opts ...Option) (*GithubRepo, error) {
+	g := &GithubRepo{
+		owner:       owner,
+		repo:        repo,
+		maxReleases: defaultMaxReleases,
+		logger:      logrus.WithFields(logrus.Fields{"repotype": "github", "owner": owner, "repo": repo}),
+	}
+	for _, opt := range opts {
+		g = opt(g)
 	}
 
-	for _, release := range releases {
-		if release.GetDraft() {
-
-			continue
+	var transport http.RoundTripper = http.DefaultTransport
+	if g.token != "" {
+		transport = &tokenTransport{token: g.token, base: transport}
+	}
+	g.transport = newConditionalTransport(transport)
+	httpClient := &http.Client{Transport: g.transport}
+	if g.baseURL != "" {
+		githubClient, err := github.NewEnterpriseClient(g.baseURL, g.baseURL, httpClient)
+		if err != nil {
+			return nil, fmt.Errorf("invalid github enterprise URL %s: %w", g.baseURL, err)
 		}
-		tagName := strings.TrimPrefix(release.GetTagName(), "v")
-		version, err := semver.NewVersion(tagName)
+		g.client = githubClient
+		g.logger = g.logger.WithField("baseURL", g.baseURL)
+	} else {
+		g.client = github.NewClient(httpClient)
+	}
+	return g, nil
+}
+
+// tokenTransport adds the access token to every API request
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
+
+// assetAPI decides whether assets are downloaded via the API. Unless configured, the API is only used for
+// private repositories, which are detected once.
+func (g *GithubRepo) assetAPI(ctx context.Context) bool {
+	if g.useAssetAPI != nil {
+		return *g.useAssetAPI
+	}
+	if g.token == "" {
+		return false
+	}
+	g.privateLock.Lock()
+	defer g.privateLock.Unlock()
+	if g.private == nil {
+		repo, _, err := g.client.Repositories.Get(ctx, g.owner, g.repo)
 		if err != nil {
-			logger.WithError(err).WithField("tagName", *release.TagName).
-				Error("release can't be used because the tag name is not a semver version")
-			continue
+			// Assets of public repositories can be downloaded via the API as well, just not streamed
+			g.logger.WithError(err).Warn("failed to determine whether the repository is private, using the asset API")
+			return true
+		}
+		private := repo.GetPrivate() || repo.GetVisibility() == "internal"
+		g.private = &private
+	}
+	return *g.private
+}
+
+// bundleFromAsset converts a release asset. If the asset API is used, rauc can't download the bundle on its
+// own as the necessary headers are attached to the bundle link.
+func (g *GithubRepo) bundleFromAsset(asset *github.ReleaseAsset, useAssetAPI bool) *repository.BundleLink {
+	bundle := &repository.BundleLink{
+		URL:       asset.GetBrowserDownloadURL(),
+		Size:      int64(asset.GetSize()),
+		AssetName: asset.GetName(),
+	}
+	if useAssetAPI {
+		bundle.URL = asset.GetURL()
+		bundle.Header = http.Header{}
+		bundle.Header.Set("Accept", "application/octet-stream")
+		if g.token != "" {
+			bundle.Header.Set("Authorization", "Bearer "+g.token)
 		}
-		update := repository.Update{
-			Version:     version,
-			ReleaseDate: release.PublishedAt.Time,
-			Name:        release.GetName(),
-			Notes:       release.GetBody(),
-			Prerelease:  release.GetPrerelease(),
+	}
+	return bundle
+}
+
+// ScanStats describes how many releases the last call to Updates looked at
+type ScanStats struct {
+	Scanned int
+	Skipped int
+	// Truncated is set if older releases exist which were not scanned because of the configured limit
+	Truncated bool
+}
+
+// LastScan returns the statistics of the last call to Updates
+func (g *GithubRepo) LastScan() ScanStats {
+	g.statsLock.Lock()
+	defer g.statsLock.Unlock()
+	return g.lastScan
+}
+
+func (g *GithubRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	logger := g.logger
+	stats := ScanStats{}
+	opts := &github.ListOptions{PerPage: releasesPerPage}
+	useAssetAPI := g.assetAPI(ctx)
+
+	for {
+		releases, resp, err := g.client.Repositories.ListReleases(ctx, g.owner, g.repo, opts)
+		if err != nil {
+			if reset, limited := rateLimited(err); limited {
+				return g.rateLimitedUpdates(reset, err)
+			}
+			return nil, fmt.Errorf("failed to query github repo %s/%s: %w", g.owner, g.repo, err)
 		}
 
-		for _, asset := range release.Assets {
-			bundle := repository.BundleLink{
-				URL:       *asset.BrowserDownloadURL,
-				Size:      int64(asset.GetSize()),
-				AssetName: asset.GetName(),
+		for _, release := range releases {
+			if g.maxReleases > 0 && stats.Scanned >= g.maxReleases {
+				stats.Truncated = true
+				break
+			}
+			stats.Scanned++
+			if release.GetDraft() {
+				stats.Skipped++
+				continue
+			}
+			version, err := g.versionFromTag(release.GetTagName())
+			if errors.Is(err, repository.ErrTagMismatch) {
+				stats.Skipped++
+				logger.WithField("tagName", release.GetTagName()).Debug("skipping release with unrelated tag")
+				continue
+			}
+			if err != nil {
+				stats.Skipped++
+				logger.WithError(err).WithField("tagName", release.GetTagName()).
+					Error("release can't be used because the tag name is not a semver version")
+				continue
+			}
+			update := repository.Update{
+				Version:     version,
+				ReleaseDate: release.GetPublishedAt().Time,
+				Name:        release.GetName(),
+				Prerelease:  release.GetPrerelease(),
+			}
+			if err := update.SetReleaseNotes(release.GetBody()); err != nil {
+				logger.WithError(err).WithField("tagName", release.GetTagName()).Warn("ignoring invalid release metadata")
+			}
+
+			for _, asset := range release.Assets {
+				update.Bundles = append(update.Bundles, g.bundleFromAsset(asset, useAssetAPI))
 			}
-			update.Bundles = append(update.Bundles, &bundle)
+
+			updates = append(updates, update)
+		}
+
+		if stats.Truncated || resp.NextPage == 0 {
+			break
 		}
+		opts.Page = resp.NextPage
+	}
+
+	logger.WithFields(logrus.Fields{
+		"scanned":   stats.Scanned,
+		"skipped":   stats.Skipped,
+		"truncated": stats.Truncated,
+	}).Info("scanned releases")
+	g.statsLock.Lock()
+	g.lastScan = stats
+	g.lastUpdates = updates
+	g.statsLock.Unlock()
+	return updates, nil
+}
+
+func (g *GithubRepo) versionFromTag(tagName string) (*semver.Version, error) {
+	if g.tagPattern != nil {
+		return g.tagPattern.Version(tagName)
+	}
+	return repository.VersionFromTag(tagName)
+}
+
+// RateLimit returns the rate limit state GitHub reported with the last response
+func (g *GithubRepo) RateLimit() RateLimitState {
+	return g.transport.RateLimit()
+}
+
+// RepositoryStatus reports the rate limit and the statistics of the last scan
+func (g *GithubRepo) RepositoryStatus() map[string]string {
+	scan := g.LastScan()
+	status := map[string]string{
+		"scannedReleases":   strconv.Itoa(scan.Scanned),
+		"skippedReleases":   strconv.Itoa(scan.Skipped),
+		"truncatedReleases": strconv.FormatBool(scan.Truncated),
+	}
+	if rateLimit := g.RateLimit(); rateLimit.Known {
+		status["rateLimit"] = strconv.Itoa(rateLimit.Limit)
+		status["rateLimitRemaining"] = strconv.Itoa(rateLimit.Remaining)
+		status["rateLimitReset"] = rateLimit.Reset.Format(time.RFC3339)
+	}
+	return status
+}
+
+// rateLimitedUpdates backs off until the rate limit is reset. In the meantime the result of the last
+// successful query is returned, as the releases are unlikely to have changed.
+func (g *GithubRepo) rateLimitedUpdates(reset time.Time, err error) ([]repository.Update, error) {
+	g.statsLock.Lock()
+	lastUpdates := g.lastUpdates
+	g.statsLock.Unlock()
+	logger := g.logger.WithField("reset", reset)
+	if lastUpdates == nil {
+		logger.Warn("github rate limit exhausted and no previous releases known")
+		return nil, fmt.Errorf("failed to query github repo %s/%s: %w", g.owner, g.repo, err)
+	}
+	logger.Warn("github rate limit exhausted, using previously queried releases")
+	return lastUpdates, nil
+}
 
-		updates = append(updates, update)
+func rateLimited(err error) (reset time.Time, limited bool) {
+	var rateLimitedErr *RateLimitedError
+	if errors.As(err, &rateLimitedErr) {
+		return rateLimitedErr.Reset, true
+	}
+	var rateLimitErr *github.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return rateLimitErr.Rate.Reset.Time, true
 	}
-	return
+	return time.Time{}, false
 }
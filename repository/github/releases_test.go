@@ -0,0 +1,163 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const releasesResponse = `[
+	{
+		"tag_name": "v1.8.2",
+		"name": "Penguin",
+		"published_at": "2023-01-20T10:00:00Z",
+		"assets": [
+			{
+				"url": "https://github.example.com/api/v3/repos/factory/firmware/releases/assets/1",
+				"browser_download_url": "https://github.example.com/factory/firmware/releases/download/v1.8.2/cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				"name": "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+				"size": 1024
+			}
+		]
+	}
+]`
+
+// newRepoServer serves the releases and the visibility of the repository
+func newRepoServer(t *testing.T, private bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/api/v3/repos/factory/firmware":
+			fmt.Fprintf(w, `{"name": "firmware", "private": %t}`, private)
+		case "/api/v3/repos/factory/firmware/releases":
+			w.Write([]byte(releasesResponse))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPrivateEnterpriseRepo(t *testing.T) {
+	srv := newRepoServer(t, true)
+
+	repo, err := NewRepo("factory", "firmware", WithEnterpriseURL(srv.URL), WithToken("secret"))
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	require.Len(t, updates[0].Bundles, 1)
+
+	bundle := updates[0].Bundles[0]
+	assert.Equal(t, "https://github.example.com/api/v3/repos/factory/firmware/releases/assets/1", bundle.URL)
+	assert.Equal(t, "application/octet-stream", bundle.Header.Get("Accept"))
+	assert.Equal(t, "Bearer secret", bundle.Header.Get("Authorization"))
+}
+
+func TestPublicRepoUsesBrowserDownloadURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		w.Write([]byte(releasesResponse))
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo("factory", "firmware", WithEnterpriseURL(srv.URL))
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	bundle := updates[0].Bundles[0]
+	assert.Equal(t, "https://github.example.com/factory/firmware/releases/download/v1.8.2/cbpifw-raspberrypi3-64_v1.8.2_update.bin", bundle.URL)
+	assert.Empty(t, bundle.Header)
+}
+
+func TestPublicRepoWithToken(t *testing.T) {
+	srv := newRepoServer(t, false)
+
+	// The token only raises the rate limit, rauc can still stream the bundles
+	repo, err := NewRepo("factory", "firmware", WithEnterpriseURL(srv.URL), WithToken("secret"))
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	bundle := updates[0].Bundles[0]
+	assert.Equal(t, "https://github.example.com/factory/firmware/releases/download/v1.8.2/cbpifw-raspberrypi3-64_v1.8.2_update.bin", bundle.URL)
+	assert.Empty(t, bundle.Header)
+
+	repo, err = NewRepo("factory", "firmware", WithEnterpriseURL(srv.URL), WithToken("secret"), UseAssetAPI(true))
+	require.NoError(t, err)
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "https://github.example.com/api/v3/repos/factory/firmware/releases/assets/1", updates[0].Bundles[0].URL)
+}
+
+func TestWalkAllPages(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		var releases []string
+		for i := 0; i < 3; i++ {
+			tag := fmt.Sprintf("v1.%d.%d", 10-page, 3-i)
+			if page == 2 && i == 1 {
+				tag = "nightly"
+			}
+			releases = append(releases, fmt.Sprintf(`{"tag_name": %q, "published_at": "2023-01-20T10:00:00Z"}`, tag))
+		}
+		if page < 3 {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v3/repos/factory/firmware/releases?page=%d>; rel="next"`, srv.URL, page+1))
+		}
+		w.Write([]byte("[" + strings.Join(releases, ",") + "]"))
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo("factory", "firmware", WithEnterpriseURL(srv.URL))
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, updates, 8)
+	assert.Equal(t, "1.7.1", updates[7].Version.String())
+	assert.Equal(t, ScanStats{Scanned: 9, Skipped: 1}, repo.LastScan())
+
+	repo, err = NewRepo("factory", "firmware", WithEnterpriseURL(srv.URL), WithMaxReleases(4))
+	require.NoError(t, err)
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, updates, 4)
+	assert.Equal(t, ScanStats{Scanned: 4, Skipped: 0, Truncated: true}, repo.LastScan())
+}
+
+func TestTagPattern(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"tag_name": "firmware-v1.9.0", "published_at": "2023-02-01T10:00:00Z",
+				"body": "---\ncritical: true\n---\nSecurity fixes"},
+			{"tag_name": "app-v3.1.0", "published_at": "2023-01-25T10:00:00Z"},
+			{"tag_name": "firmware-vnext", "published_at": "2023-01-22T10:00:00Z"},
+			{"tag_name": "firmware-v1.8.2", "published_at": "2023-01-20T10:00:00Z"}
+		]`))
+	}))
+	t.Cleanup(srv.Close)
+
+	pattern, err := repository.NewTagPattern("firmware-v{version}")
+	require.NoError(t, err)
+	repo, err := NewRepo("factory", "monorepo", WithEnterpriseURL(srv.URL), WithTagPattern(pattern))
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+	assert.Equal(t, "1.9.0", updates[0].Version.String())
+	assert.True(t, updates[0].Critical)
+	assert.Equal(t, "Security fixes", updates[0].Notes)
+	assert.Equal(t, "1.8.2", updates[1].Version.String())
+	assert.Equal(t, ScanStats{Scanned: 4, Skipped: 2}, repo.LastScan())
+}
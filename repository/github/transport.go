@@ -0,0 +1,161 @@
+package github
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitState is the rate limit GitHub reported with the last response
+type RateLimitState struct {
+	Limit     int
+	Remaining int
+	Used      int
+	Reset     time.Time
+	// Known is false as long as GitHub didn't report any rate limit
+	Known bool
+}
+
+// Exhausted returns true if no requests are left until the rate limit is reset
+func (r RateLimitState) Exhausted(now time.Time) bool {
+	return r.Known && r.Remaining <= 0 && now.Before(r.Reset)
+}
+
+// RateLimitedError is returned instead of sending requests while the rate limit is exhausted
+type RateLimitedError struct {
+	Reset time.Time
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("github rate limit exhausted until %s", e.Reset.Format(time.RFC3339))
+}
+
+type cachedResponse struct {
+	etag         string
+	lastModified string
+	header       http.Header
+	body         []byte
+}
+
+// conditionalTransport remembers ETag and Last-Modified of every GET request and sends conditional requests.
+// GitHub doesn't count 304 responses against the rate limit, so unchanged release lists are free. It also
+// tracks the rate limit and doesn't send any requests until it is reset once it is exhausted.
+type conditionalTransport struct {
+	base http.RoundTripper
+	now  func() time.Time
+
+	lock      sync.Mutex
+	cache     map[string]*cachedResponse
+	rateLimit RateLimitState
+}
+
+func newConditionalTransport(base http.RoundTripper) *conditionalTransport {
+	return &conditionalTransport{
+		base:  base,
+		now:   time.Now,
+		cache: make(map[string]*cachedResponse),
+	}
+}
+
+func (t *conditionalTransport) RateLimit() RateLimitState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rateLimit
+}
+
+func (t *conditionalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	rateLimit := t.rateLimit
+	cached := t.cache[req.URL.String()]
+	t.lock.Unlock()
+
+	if rateLimit.Exhausted(t.now()) {
+		return nil, &RateLimitedError{Reset: rateLimit.Reset}
+	}
+
+	if req.Method != http.MethodGet {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil {
+			t.updateRateLimit(resp.Header)
+		}
+		return resp, err
+	}
+
+	if cached != nil {
+		req = req.Clone(req.Context())
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.updateRateLimit(resp.Header)
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		header := cached.header.Clone()
+		for _, key := range rateLimitHeaders {
+			if value := resp.Header.Get(key); value != "" {
+				header.Set(key, value)
+			}
+		}
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         resp.Proto,
+			ProtoMajor:    resp.ProtoMajor,
+			ProtoMinor:    resp.ProtoMinor,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(cached.body)),
+			ContentLength: int64(len(cached.body)),
+			Request:       req,
+		}, nil
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || (etag == "" && lastModified == "") {
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	t.cache[req.URL.String()] = &cachedResponse{
+		etag:         etag,
+		lastModified: lastModified,
+		header:       resp.Header.Clone(),
+		body:         body,
+	}
+	t.lock.Unlock()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+var rateLimitHeaders = []string{"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Used", "X-RateLimit-Reset"}
+
+func (t *conditionalTransport) updateRateLimit(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	state := RateLimitState{Remaining: remaining, Known: true}
+	state.Limit, _ = strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	state.Used, _ = strconv.Atoi(header.Get("X-RateLimit-Used"))
+	if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		state.Reset = time.Unix(reset, 0)
+	}
+	t.lock.Lock()
+	t.rateLimit = state
+	t.lock.Unlock()
+}
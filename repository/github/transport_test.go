@@ -0,0 +1,84 @@
+package github
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConditionalRequestsAndRateLimit(t *testing.T) {
+	var requests, notModified int32
+	remaining := int32(10)
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("X-RateLimit-Limit", "60")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(atomic.LoadInt32(&remaining))))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if r.Header.Get("If-None-Match") == `"releases-v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"releases-v1"`)
+		w.Write([]byte(releasesResponse))
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo("factory", "firmware", WithEnterpriseURL(srv.URL))
+	require.NoError(t, err)
+
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1, "cached release list should be used on 304")
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	assert.EqualValues(t, 1, notModified)
+
+	rateLimit := repo.RateLimit()
+	assert.True(t, rateLimit.Known)
+	assert.Equal(t, 60, rateLimit.Limit)
+	assert.Equal(t, 10, rateLimit.Remaining)
+	assert.Equal(t, reset, rateLimit.Reset)
+	status := repo.RepositoryStatus()
+	assert.Equal(t, "10", status["rateLimitRemaining"])
+	assert.Equal(t, reset.Format(time.RFC3339), status["rateLimitReset"])
+	assert.Equal(t, "1", status["scannedReleases"])
+
+	// Exhaust the rate limit, afterwards no requests must be sent until the reset
+	atomic.StoreInt32(&remaining, 0)
+	_, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.True(t, repo.RateLimit().Exhausted(time.Now()))
+
+	sentRequests := atomic.LoadInt32(&requests)
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, updates, 1, "previous releases should be returned while rate limited")
+	assert.Equal(t, sentRequests, atomic.LoadInt32(&requests))
+}
+
+func TestRateLimitedWithoutPreviousResult(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("no request should be sent while the rate limit is exhausted")
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo("factory", "firmware", WithEnterpriseURL(srv.URL))
+	require.NoError(t, err)
+	repo.transport.rateLimit = RateLimitState{Known: true, Remaining: 0, Reset: time.Now().Add(time.Hour)}
+
+	_, err = repo.Updates(context.Background())
+	var rateLimitedErr *RateLimitedError
+	assert.ErrorAs(t, err, &rateLimitedErr)
+}
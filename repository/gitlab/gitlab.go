@@ -0,0 +1,171 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultBaseURL  = "https://gitlab.com"
+	releasesPerPage = 100
+)
+
+type release struct {
+	TagName         string    `json:"tag_name"`
+	Name            string    `json:"name"`
+	Description     string    `json:"description"`
+	ReleasedAt      time.Time `json:"released_at"`
+	UpcomingRelease bool      `json:"upcoming_release"`
+	Assets          struct {
+		Links []releaseLink `json:"links"`
+	} `json:"assets"`
+}
+
+type releaseLink struct {
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	DirectAssetURL string `json:"direct_asset_url"`
+	LinkType       string `json:"link_type"`
+}
+
+type GitlabRepo struct {
+	client  *http.Client
+	baseURL string
+	project string
+	token   string
+	logger  logrus.FieldLogger
+}
+
+func init() {
+	repository.RegisterBuilder("gitlab", New)
+}
+
+func New(conf *viper.Viper) (repository.Repository, error) {
+	conf.SetDefault("baseURL", defaultBaseURL)
+	baseURL := conf.GetString("baseURL")
+	project := conf.GetString("project")
+	token := conf.GetString("token")
+	return NewRepo(baseURL, project, token)
+}
+
+// NewRepo creates a repository for the releases of a GitLab project. The project can either be the numeric
+// project ID or the full path like group/project. The token is optional and only necessary for private projects.
+func NewRepo(baseURL, project, token string) (*GitlabRepo, error) {
+	if project == "" {
+		return nil, fmt.Errorf("no gitlab project specified")
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid gitlab base URL %s: %w", baseURL, err)
+	}
+	return &GitlabRepo{
+		client:  http.DefaultClient,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		project: project,
+		token:   token,
+		logger:  logrus.WithFields(logrus.Fields{"repotype": "gitlab", "baseURL": baseURL, "project": project}),
+	}, nil
+}
+
+func (g *GitlabRepo) releasesURL(page string) string {
+	return fmt.Sprintf("%s/api/v4/projects/%s/releases?per_page=%d&page=%s", g.baseURL, url.PathEscape(g.project),
+		releasesPerPage, url.QueryEscape(page))
+}
+
+// releases fetches a page of releases and returns the number of the next page, which is empty on the last page
+func (g *GitlabRepo) releases(ctx context.Context, page string) (releases []release, nextPage string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.releasesURL(page), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request for gitlab project %s: %w", g.project, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if g.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", g.token)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query gitlab project %s: %w", g.project, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to query gitlab project %s: unexpected status %s", g.project, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&releases); err != nil {
+		return nil, "", fmt.Errorf("failed to decode releases of gitlab project %s: %w", g.project, err)
+	}
+	return releases, resp.Header.Get("X-Next-Page"), nil
+}
+
+func (g *GitlabRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	logger := g.logger
+	for page := "1"; page != ""; {
+		var releases []release
+		releases, page, err = g.releases(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		if len(releases) == 0 {
+			break
+		}
+		for _, release := range releases {
+			version, err := repository.VersionFromTag(release.TagName)
+			if err != nil {
+				logger.WithError(err).WithField("tagName", release.TagName).
+					Error("release can't be used because the tag name is not a semver version")
+				continue
+			}
+			update := repository.Update{
+				Version:     version,
+				ReleaseDate: release.ReleasedAt,
+				Name:        release.Name,
+				// GitLab has no explicit prerelease flag, so we rely on the version and upcoming releases
+				Prerelease: version.PreRelease != "" || release.UpcomingRelease,
+			}
+			if err := update.SetReleaseNotes(release.Description); err != nil {
+				logger.WithError(err).WithField("tagName", release.TagName).Warn("ignoring invalid release metadata")
+			}
+
+			for _, link := range release.Assets.Links {
+				update.Bundles = append(update.Bundles, g.bundleFromLink(link))
+			}
+
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
+
+// bundleFromLink converts a release link into a bundle link. Release links can point anywhere, but are usually
+// either direct asset links or links into the generic package registry. The link name is free text in GitLab,
+// so the asset name is taken from the file name in the URL which is needed to determine the compatibility.
+// The token is only sent along with links to the GitLab instance itself.
+func (g *GitlabRepo) bundleFromLink(link releaseLink) *repository.BundleLink {
+	bundleURL := link.DirectAssetURL
+	if bundleURL == "" {
+		bundleURL = link.URL
+	}
+	assetName := link.Name
+	if u, err := url.Parse(bundleURL); err == nil {
+		if _, fileName := path.Split(u.Path); fileName != "" {
+			assetName = fileName
+		}
+	}
+	bundle := &repository.BundleLink{
+		URL:       bundleURL,
+		AssetName: assetName,
+	}
+	if g.token != "" && strings.HasPrefix(bundleURL, g.baseURL+"/") {
+		bundle.Header = http.Header{}
+		bundle.Header.Set("PRIVATE-TOKEN", g.token)
+	}
+	return bundle
+}
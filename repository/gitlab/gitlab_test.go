@@ -0,0 +1,114 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const releasesResponse = `[
+	{
+		"tag_name": "v1.8.2",
+		"name": "Penguin",
+		"description": "Some notes",
+		"released_at": "2023-01-20T10:00:00Z",
+		"upcoming_release": false,
+		"assets": {
+			"links": [
+				{
+					"name": "Raspberry Pi 3 bundle",
+					"url": "https://gitlab.example.com/api/v4/projects/42/packages/generic/firmware/1.8.2/cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+					"link_type": "package"
+				},
+				{
+					"name": "cbpifw-raspberrypi4-64_v1.8.2_update.bin",
+					"url": "https://gitlab.example.com/uploads/abcdef/cbpifw-raspberrypi4-64_v1.8.2_update.bin",
+					"direct_asset_url": "https://gitlab.example.com/group/firmware/-/releases/v1.8.2/downloads/cbpifw-raspberrypi4-64_v1.8.2_update.bin",
+					"link_type": "other"
+				}
+			]
+		}
+	},
+	{
+		"tag_name": "v1.9.0-rc1",
+		"name": "Walrus",
+		"released_at": "2023-02-20T10:00:00Z"
+	},
+	{
+		"tag_name": "not-a-version",
+		"name": "Broken"
+	}
+]`
+
+func TestQueryingReleases(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v4/projects/group%2Ffirmware/releases", r.URL.EscapedPath())
+		assert.Equal(t, "secret", r.Header.Get("PRIVATE-TOKEN"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(releasesResponse))
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo(srv.URL, "group/firmware", "secret")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	assert.Equal(t, "Penguin", updates[0].Name)
+	assert.Equal(t, "Some notes", updates[0].Notes)
+	assert.False(t, updates[0].Prerelease)
+	require.Len(t, updates[0].Bundles, 2)
+	assert.Equal(t, "cbpifw-raspberrypi3-64_v1.8.2_update.bin", updates[0].Bundles[0].AssetName)
+	assert.Equal(t, "https://gitlab.example.com/group/firmware/-/releases/v1.8.2/downloads/cbpifw-raspberrypi4-64_v1.8.2_update.bin",
+		updates[0].Bundles[1].URL)
+
+	assert.Equal(t, "1.9.0-rc1", updates[1].Version.String())
+	assert.True(t, updates[1].Prerelease)
+}
+
+func TestQueryingReleasesFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo(srv.URL, "42", "")
+	require.NoError(t, err)
+	_, err = repo.Updates(context.Background())
+	assert.Error(t, err)
+}
+
+func TestWalkAllPagesWithToken(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("PRIVATE-TOKEN"))
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		require.NoError(t, err)
+		if page < 3 {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+		fmt.Fprintf(w, `[{"tag_name": "v1.%d.0", "assets": {"links": [
+			{"url": "%s/api/v4/projects/42/packages/generic/firmware/1.%d.0/cbpifw-raspberrypi3-64_v1.%d.0_update.bin"},
+			{"url": "https://cdn.example.com/cbpifw-raspberrypi4-64_v1.%d.0_update.bin"}
+		]}}]`, page, srv.URL, page, page, page)
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo(srv.URL, "42", "secret")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 3)
+	assert.Equal(t, "1.3.0", updates[2].Version.String())
+	// Private projects need the token for downloads, but it must not leak to other hosts
+	assert.Equal(t, "secret", updates[0].Bundles[0].Header.Get("PRIVATE-TOKEN"))
+	assert.Empty(t, updates[0].Bundles[1].Header)
+}
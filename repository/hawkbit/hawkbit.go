@@ -0,0 +1,551 @@
+package hawkbit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// DefaultStateFile keeps the installed action until the device booted into it
+	DefaultStateFile = "/var/lib/raucgithub/hawkbit.json"
+	bootIDFile       = "/proc/sys/kernel/random/boot_id"
+
+	defaultTenant       = "DEFAULT"
+	defaultPollInterval = 5 * time.Minute
+	// Progress feedback is sent at most this often, the final 100% is always sent
+	progressInterval = 10 * time.Second
+
+	handlingSkip = "skip"
+
+	executionProceeding = "proceeding"
+	executionClosed     = "closed"
+
+	finishedNone    = "none"
+	finishedSuccess = "success"
+	finishedFailure = "failure"
+)
+
+type link struct {
+	Href string `json:"href"`
+}
+
+type controllerBase struct {
+	Config struct {
+		Polling struct {
+			Sleep string `json:"sleep"`
+		} `json:"polling"`
+	} `json:"config"`
+	Links map[string]link `json:"_links"`
+}
+
+type deploymentBase struct {
+	ID         string `json:"id"`
+	Deployment struct {
+		Download          string  `json:"download"`
+		Update            string  `json:"update"`
+		MaintenanceWindow string  `json:"maintenanceWindow"`
+		Chunks            []chunk `json:"chunks"`
+	} `json:"deployment"`
+}
+
+type chunk struct {
+	Part      string     `json:"part"`
+	Version   string     `json:"version"`
+	Name      string     `json:"name"`
+	Artifacts []artifact `json:"artifacts"`
+}
+
+type artifact struct {
+	Filename string            `json:"filename"`
+	Size     int64             `json:"size"`
+	Hashes   map[string]string `json:"hashes"`
+	Links    map[string]link   `json:"_links"`
+}
+
+type feedback struct {
+	Status feedbackStatus `json:"status"`
+}
+
+type feedbackStatus struct {
+	Execution string         `json:"execution"`
+	Result    feedbackResult `json:"result"`
+	Details   []string       `json:"details,omitempty"`
+}
+
+type feedbackResult struct {
+	Finished string            `json:"finished"`
+	Progress *feedbackProgress `json:"progress,omitempty"`
+}
+
+type feedbackProgress struct {
+	Cnt int32 `json:"cnt"`
+	Of  int32 `json:"of"`
+}
+
+// pendingAction is an action whose update has been installed, but not booted yet
+type pendingAction struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	BootID  string `json:"bootID"`
+}
+
+// action tracks the updates of a deployment action, which has one update per version of its chunks
+type action struct {
+	updates    int
+	rejections []string
+}
+
+// HawkbitRepo acts as a target of the hawkBit Direct Device Integration API. Deployment actions assigned to
+// this device are offered as updates and the installation progress is reported back as action feedback.
+// Installed actions are only closed once the device booted the new version.
+type HawkbitRepo struct {
+	client       *http.Client
+	baseURL      string
+	tenant       string
+	controllerID string
+	authHeader   string
+	stateFile    string
+	bootIDFile   string
+	logger       logrus.FieldLogger
+
+	pollLock     sync.Mutex
+	pollInterval time.Duration
+
+	progressLock sync.Mutex
+	lastProgress time.Time
+
+	actionsLock sync.Mutex
+	actions     map[string]*action
+	pending     *pendingAction
+}
+
+type Option func(*HawkbitRepo) *HawkbitRepo
+
+// WithStateFile keeps the installed action in file, so its result can be reported after the reboot
+func WithStateFile(file string) Option {
+	return func(h *HawkbitRepo) *HawkbitRepo {
+		h.stateFile = file
+		return h
+	}
+}
+
+func init() {
+	repository.RegisterBuilder("hawkbit", New)
+}
+
+func New(conf *viper.Viper) (repository.Repository, error) {
+	conf.SetDefault("tenant", defaultTenant)
+	controllerID := conf.GetString("controllerID")
+	if controllerID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("no controllerID configured and failed to determine hostname: %w", err)
+		}
+		controllerID = hostname
+	}
+	authHeader := ""
+	if token := conf.GetString("targetToken"); token != "" {
+		authHeader = "TargetToken " + token
+	} else if token := conf.GetString("gatewayToken"); token != "" {
+		authHeader = "GatewayToken " + token
+	}
+	conf.SetDefault("stateFile", DefaultStateFile)
+	return NewRepo(conf.GetString("baseURL"), conf.GetString("tenant"), controllerID, authHeader,
+		WithStateFile(conf.GetString("stateFile")))
+}
+
+// NewRepo creates a DDI client for the given controller. authHeader is the complete value of the Authorization
+// header, i.e. TargetToken <token>, and can be empty if the hawkBit server allows anonymous access.
+func NewRepo(baseURL, tenant, controllerID, authHeader string, opts ...Option) (*HawkbitRepo, error) {
+	if baseURL == "" {
+		return nil, errors.New("no hawkBit base URL specified")
+	}
+	if controllerID == "" {
+		return nil, errors.New("no hawkBit controller ID specified")
+	}
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	h := &HawkbitRepo{
+		client:       http.DefaultClient,
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		tenant:       tenant,
+		controllerID: controllerID,
+		authHeader:   authHeader,
+		bootIDFile:   bootIDFile,
+		pollInterval: defaultPollInterval,
+		actions:      make(map[string]*action),
+		logger: logrus.WithFields(logrus.Fields{"repotype": "hawkbit", "baseURL": baseURL,
+			"tenant": tenant, "controllerID": controllerID}),
+	}
+	for _, opt := range opts {
+		h = opt(h)
+	}
+	if err := h.loadPending(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *HawkbitRepo) loadPending() error {
+	if h.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(h.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read hawkBit state from %s: %w", h.stateFile, err)
+	}
+	pending := &pendingAction{}
+	if err := json.Unmarshal(data, pending); err != nil {
+		h.logger.WithError(err).WithField("stateFile", h.stateFile).Warn("ignoring invalid hawkBit state")
+		return nil
+	}
+	h.pending = pending
+	return nil
+}
+
+// setPending remembers the installed action, the caller must hold actionsLock
+func (h *HawkbitRepo) setPending(pending *pendingAction) error {
+	h.pending = pending
+	if h.stateFile == "" {
+		return nil
+	}
+	if pending == nil {
+		if err := os.Remove(h.stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove hawkBit state %s: %w", h.stateFile, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.stateFile), 0700); err != nil {
+		return fmt.Errorf("failed to create directory of hawkBit state %s: %w", h.stateFile, err)
+	}
+	if err := os.WriteFile(h.stateFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to store hawkBit state in %s: %w", h.stateFile, err)
+	}
+	return nil
+}
+
+func (h *HawkbitRepo) bootID() string {
+	data, err := os.ReadFile(h.bootIDFile)
+	if err != nil {
+		h.logger.WithError(err).Warn("failed to read boot id, reboots can't be detected")
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (h *HawkbitRepo) controllerURL() string {
+	return fmt.Sprintf("%s/%s/controller/v1/%s", h.baseURL, h.tenant, h.controllerID)
+}
+
+func (h *HawkbitRepo) do(ctx context.Context, method, reqURL string, body, v interface{}) error {
+	var payload *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	} else {
+		payload = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/hal+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if h.authHeader != "" {
+		req.Header.Set("Authorization", h.authHeader)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s for %s %s", resp.Status, method, reqURL)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return fmt.Errorf("failed to decode response of %s: %w", reqURL, err)
+		}
+	}
+	return nil
+}
+
+func (h *HawkbitRepo) poll(ctx context.Context) (*controllerBase, error) {
+	var base controllerBase
+	if err := h.do(ctx, http.MethodGet, h.controllerURL(), nil, &base); err != nil {
+		return nil, fmt.Errorf("failed to poll controller base resource: %w", err)
+	}
+	if sleep, err := parseSleep(base.Config.Polling.Sleep); err == nil && sleep > 0 {
+		h.pollLock.Lock()
+		h.pollInterval = sleep
+		h.pollLock.Unlock()
+	}
+	return &base, nil
+}
+
+func (h *HawkbitRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	logger := h.logger
+	base, err := h.poll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deploymentLink, exists := base.Links["deploymentBase"]
+	if !exists {
+		// Nothing is assigned to this device right now
+		return nil, nil
+	}
+	var deployment deploymentBase
+	if err := h.do(ctx, http.MethodGet, deploymentLink.Href, nil, &deployment); err != nil {
+		return nil, fmt.Errorf("failed to load deployment: %w", err)
+	}
+	logger = logger.WithField("actionID", deployment.ID)
+	if deployment.Deployment.Update == handlingSkip || deployment.Deployment.MaintenanceWindow == "unavailable" {
+		logger.Info("deployment must not be installed right now")
+		return nil, nil
+	}
+
+	h.actionsLock.Lock()
+	defer h.actionsLock.Unlock()
+	if h.pending != nil && h.pending.ID == deployment.ID && h.pending.BootID == h.bootID() {
+		logger.Info("deployment has been installed, waiting for reboot")
+		return nil, nil
+	}
+
+	// Chunks of the same version, i.e. bundles for several boards, are offered as a single update
+	byVersion := make(map[string]*repository.Update)
+	var versions []string
+	for _, c := range deployment.Deployment.Chunks {
+		version, err := repository.VersionFromTag(c.Version)
+		if err != nil {
+			logger.WithError(err).WithField("version", c.Version).
+				Error("software module can't be used because the version is not a semver version")
+			continue
+		}
+		update, exists := byVersion[version.String()]
+		if !exists {
+			update = &repository.Update{
+				ID:      deployment.ID,
+				Version: version,
+				Name:    c.Name,
+			}
+			byVersion[version.String()] = update
+			versions = append(versions, version.String())
+		}
+		for _, a := range c.Artifacts {
+			downloadLink, exists := a.Links["download"]
+			if !exists {
+				downloadLink = a.Links["download-http"]
+			}
+			if downloadLink.Href == "" {
+				continue
+			}
+			bundle := &repository.BundleLink{
+				URL:       downloadLink.Href,
+				AssetName: a.Filename,
+				Size:      a.Size,
+				SHA256:    a.Hashes["sha256"],
+			}
+			if h.authHeader != "" {
+				// Artifact downloads require the same authentication as the DDI API
+				bundle.Header = http.Header{"Authorization": {h.authHeader}}
+			}
+			update.Bundles = append(update.Bundles, bundle)
+		}
+	}
+	for _, version := range versions {
+		updates = append(updates, *byVersion[version])
+	}
+	h.actions = map[string]*action{deployment.ID: {updates: len(updates)}}
+	return updates, nil
+}
+
+// Watch polls the controller base resource in the interval requested by the hawkBit server and calls changed
+// whenever a new deployment action is assigned to this device
+func (h *HawkbitRepo) Watch(ctx context.Context, changed func()) error {
+	go func() {
+		lastDeployment := ""
+		for {
+			h.pollLock.Lock()
+			interval := h.pollInterval
+			h.pollLock.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			base, err := h.poll(ctx)
+			if err != nil {
+				h.logger.WithError(err).Warn("failed to poll hawkBit")
+				continue
+			}
+			deployment := base.Links["deploymentBase"].Href
+			if deployment != "" && deployment != lastDeployment {
+				h.logger.WithField("deployment", deployment).Info("new deployment assigned")
+				changed()
+			}
+			lastDeployment = deployment
+		}
+	}()
+	return nil
+}
+
+func (h *HawkbitRepo) sendFeedback(ctx context.Context, update *repository.Update, status feedbackStatus) error {
+	if update.ID == "" {
+		return errors.New("update has no hawkBit action ID")
+	}
+	feedbackURL := fmt.Sprintf("%s/deploymentBase/%s/feedback", h.controllerURL(), update.ID)
+	if err := h.do(ctx, http.MethodPost, feedbackURL, feedback{Status: status}, nil); err != nil {
+		return fmt.Errorf("failed to send feedback for action %s: %w", update.ID, err)
+	}
+	return nil
+}
+
+func (h *HawkbitRepo) InstallStarted(ctx context.Context, update *repository.Update) error {
+	h.progressLock.Lock()
+	h.lastProgress = time.Time{}
+	h.progressLock.Unlock()
+	return h.sendFeedback(ctx, update, feedbackStatus{
+		Execution: executionProceeding,
+		Result:    feedbackResult{Finished: finishedNone},
+		Details:   []string{"Installing " + update.Version.String()},
+	})
+}
+
+func (h *HawkbitRepo) InstallProgress(ctx context.Context, update *repository.Update, percentage int32) error {
+	h.progressLock.Lock()
+	if percentage < 100 && time.Since(h.lastProgress) < progressInterval {
+		h.progressLock.Unlock()
+		return nil
+	}
+	h.lastProgress = time.Now()
+	h.progressLock.Unlock()
+	return h.sendFeedback(ctx, update, feedbackStatus{
+		Execution: executionProceeding,
+		Result: feedbackResult{
+			Finished: finishedNone,
+			Progress: &feedbackProgress{Cnt: percentage, Of: 100},
+		},
+	})
+}
+
+// InstallFinished closes the action of a failed installation. A successful installation is only reported as
+// proceeding, the action is closed by BootedVersion once the device booted the new version.
+func (h *HawkbitRepo) InstallFinished(ctx context.Context, update *repository.Update, installErr error) error {
+	if installErr != nil {
+		return h.sendFeedback(ctx, update, feedbackStatus{
+			Execution: executionClosed,
+			Result:    feedbackResult{Finished: finishedFailure},
+			Details:   []string{installErr.Error()},
+		})
+	}
+	h.actionsLock.Lock()
+	err := h.setPending(&pendingAction{ID: update.ID, Version: update.Version.String(), BootID: h.bootID()})
+	h.actionsLock.Unlock()
+	if err != nil {
+		h.logger.WithError(err).Warn("failed to remember installed action, its result is reported once it is offered again")
+	}
+	return h.sendFeedback(ctx, update, feedbackStatus{
+		Execution: executionProceeding,
+		Result:    feedbackResult{Finished: finishedNone},
+		Details:   []string{"Installed " + update.Version.String() + ", waiting for reboot"},
+	})
+}
+
+// BootedVersion closes the installed action once the device has been rebooted. If another version than the
+// installed one is running, i.e. because rauc fell back to the other slot, the action failed.
+func (h *HawkbitRepo) BootedVersion(ctx context.Context, version *semver.Version) error {
+	h.actionsLock.Lock()
+	defer h.actionsLock.Unlock()
+	if h.pending == nil || h.pending.BootID == h.bootID() {
+		return nil
+	}
+	update := &repository.Update{ID: h.pending.ID}
+	status := feedbackStatus{
+		Execution: executionClosed,
+		Result:    feedbackResult{Finished: finishedSuccess},
+		Details:   []string{"Booted " + version.String()},
+	}
+	if version.String() != h.pending.Version {
+		status.Result.Finished = finishedFailure
+		status.Details = []string{fmt.Sprintf("Installed %s, but %s is running after reboot", h.pending.Version, version)}
+	}
+	if err := h.sendFeedback(ctx, update, status); err != nil {
+		return err
+	}
+	return h.setPending(nil)
+}
+
+// UpdateRejected closes the deployment action once all of its updates won't be installed, otherwise hawkBit
+// would consider the action as running forever
+func (h *HawkbitRepo) UpdateRejected(ctx context.Context, update *repository.Update, reason error) error {
+	if errors.Is(reason, repository.ErrAlreadyInstalled) {
+		return h.sendFeedback(ctx, update, feedbackStatus{
+			Execution: executionClosed,
+			Result:    feedbackResult{Finished: finishedSuccess},
+			Details:   []string{"Already installed " + update.Version.String()},
+		})
+	}
+	h.actionsLock.Lock()
+	a, exists := h.actions[update.ID]
+	if !exists {
+		a = &action{updates: 1}
+		h.actions[update.ID] = a
+	}
+	a.rejections = append(a.rejections, fmt.Sprintf("Rejected %s: %s", update.Version, reason))
+	rejections := append([]string{}, a.rejections...)
+	complete := len(rejections) >= a.updates
+	h.actionsLock.Unlock()
+	if !complete {
+		// Another chunk of the action might still be installed
+		return nil
+	}
+	return h.sendFeedback(ctx, update, feedbackStatus{
+		Execution: executionClosed,
+		Result:    feedbackResult{Finished: finishedFailure},
+		Details:   rejections,
+	})
+}
+
+// parseSleep parses the polling interval hawkBit sends in the format HH:MM:SS
+func parseSleep(sleep string) (time.Duration, error) {
+	parts := strings.Split(sleep, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid polling interval %s", sleep)
+	}
+	var duration time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		value, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid polling interval %s: %w", sleep, err)
+		}
+		duration += time.Duration(value) * unit
+	}
+	return duration, nil
+}
@@ -0,0 +1,224 @@
+package hawkbit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDDI struct {
+	*httptest.Server
+	lock     sync.Mutex
+	feedback []feedback
+	chunks   string
+}
+
+const defaultChunks = `[{
+	"part": "os",
+	"version": "1.8.2",
+	"name": "Penguin",
+	"artifacts": [{
+		"filename": "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+		"size": 1024,
+		"hashes": {"sha256": "abcd"},
+		"_links": {
+			"download": {"href": "https://hawkbit.example.com/download/1"},
+			"download-http": {"href": "http://hawkbit.example.com/download/1"}
+		}
+	}]
+}]`
+
+func newFakeDDI(t *testing.T) *fakeDDI {
+	f := &fakeDDI{chunks: defaultChunks}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "TargetToken secret", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/DEFAULT/controller/v1/device-1":
+			w.Write([]byte(`{
+				"config": {"polling": {"sleep": "00:00:30"}},
+				"_links": {"deploymentBase": {"href": "` + f.URL + `/DEFAULT/controller/v1/device-1/deploymentBase/42?c=-2129030598"}}
+			}`))
+		case "/DEFAULT/controller/v1/device-1/deploymentBase/42":
+			w.Write([]byte(`{
+				"id": "42",
+				"deployment": {
+					"download": "forced",
+					"update": "forced",
+					"chunks": ` + f.chunks + `
+				}
+			}`))
+		case "/DEFAULT/controller/v1/device-1/deploymentBase/42/feedback":
+			var fb feedback
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&fb))
+			f.lock.Lock()
+			f.feedback = append(f.feedback, fb)
+			f.lock.Unlock()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func TestDeploymentAsUpdate(t *testing.T) {
+	ddi := newFakeDDI(t)
+	repo, err := NewRepo(ddi.URL, "", "device-1", "TargetToken secret")
+	require.NoError(t, err)
+
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, "42", updates[0].ID)
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	assert.Equal(t, "Penguin", updates[0].Name)
+	require.Len(t, updates[0].Bundles, 1)
+	assert.Equal(t, "https://hawkbit.example.com/download/1", updates[0].Bundles[0].URL)
+	assert.Equal(t, "cbpifw-raspberrypi3-64_v1.8.2_update.bin", updates[0].Bundles[0].AssetName)
+	assert.Equal(t, "TargetToken secret", updates[0].Bundles[0].Header.Get("Authorization"))
+	assert.Equal(t, "abcd", updates[0].Bundles[0].SHA256)
+	assert.Equal(t, 30*time.Second, repo.pollInterval)
+}
+
+func TestInstallFeedback(t *testing.T) {
+	ddi := newFakeDDI(t)
+	repo, err := NewRepo(ddi.URL, "", "device-1", "TargetToken secret")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	update := &updates[0]
+
+	require.NoError(t, repo.InstallStarted(context.Background(), update))
+	require.NoError(t, repo.InstallProgress(context.Background(), update, 50))
+	// Progress is rate limited, except for the completed installation
+	require.NoError(t, repo.InstallProgress(context.Background(), update, 51))
+	require.NoError(t, repo.InstallProgress(context.Background(), update, 100))
+	require.NoError(t, repo.InstallFinished(context.Background(), update, errors.New("slot write failed")))
+
+	require.Len(t, ddi.feedback, 4)
+	assert.Equal(t, executionProceeding, ddi.feedback[0].Status.Execution)
+	assert.EqualValues(t, 50, ddi.feedback[1].Status.Result.Progress.Cnt)
+	assert.EqualValues(t, 100, ddi.feedback[2].Status.Result.Progress.Cnt)
+	assert.Equal(t, executionClosed, ddi.feedback[3].Status.Execution)
+	assert.Equal(t, finishedFailure, ddi.feedback[3].Status.Result.Finished)
+	assert.Equal(t, []string{"slot write failed"}, ddi.feedback[3].Status.Details)
+}
+
+func TestRejectDeployment(t *testing.T) {
+	ddi := newFakeDDI(t)
+	repo, err := NewRepo(ddi.URL, "", "device-1", "TargetToken secret")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+
+	require.NoError(t, repo.UpdateRejected(context.Background(), &updates[0], errors.New("device is not subscribed to channel internal")))
+	require.NoError(t, repo.UpdateRejected(context.Background(), &updates[0], repository.ErrAlreadyInstalled))
+
+	require.Len(t, ddi.feedback, 2)
+	assert.Equal(t, executionClosed, ddi.feedback[0].Status.Execution)
+	assert.Equal(t, finishedFailure, ddi.feedback[0].Status.Result.Finished)
+	assert.Equal(t, []string{"Rejected 1.8.2: device is not subscribed to channel internal"}, ddi.feedback[0].Status.Details)
+	assert.Equal(t, finishedSuccess, ddi.feedback[1].Status.Result.Finished)
+}
+
+func TestRejectChunks(t *testing.T) {
+	ddi := newFakeDDI(t)
+	ddi.chunks = `[
+		{"part": "os", "version": "1.8.2", "name": "Penguin", "artifacts": [{
+			"filename": "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+			"_links": {"download": {"href": "https://hawkbit.example.com/download/1"}}
+		}]},
+		{"part": "os", "version": "1.8.2", "name": "Penguin", "artifacts": [{
+			"filename": "cbpifw-raspberrypi4-64_v1.8.2_update.bin",
+			"_links": {"download": {"href": "https://hawkbit.example.com/download/2"}}
+		}]},
+		{"part": "os", "version": "1.9.0", "name": "Penguin", "artifacts": [{
+			"filename": "cbpifw-raspberrypi5-64_v1.9.0_update.bin",
+			"_links": {"download": {"href": "https://hawkbit.example.com/download/3"}}
+		}]}
+	]`
+	repo, err := NewRepo(ddi.URL, "", "device-1", "TargetToken secret")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	// Chunks of the same version are a single update
+	require.Len(t, updates, 2)
+	assert.Len(t, updates[0].Bundles, 2)
+
+	// The action is only closed once no chunk will be installed
+	require.NoError(t, repo.UpdateRejected(context.Background(), &updates[1], errors.New("no update bundle for compatible cbpifw-raspberrypi3-64")))
+	assert.Empty(t, ddi.feedback)
+	require.NoError(t, repo.UpdateRejected(context.Background(), &updates[0], errors.New("device is not subscribed to channel internal")))
+	require.Len(t, ddi.feedback, 1)
+	assert.Equal(t, executionClosed, ddi.feedback[0].Status.Execution)
+	assert.Equal(t, finishedFailure, ddi.feedback[0].Status.Result.Finished)
+	assert.Len(t, ddi.feedback[0].Status.Details, 2)
+}
+
+func TestReportResultAfterReboot(t *testing.T) {
+	ddi := newFakeDDI(t)
+	dir := t.TempDir()
+	bootID := filepath.Join(dir, "boot_id")
+	stateFile := filepath.Join(dir, "hawkbit.json")
+	require.NoError(t, os.WriteFile(bootID, []byte("boot-1\n"), 0644))
+	newRepo := func() *HawkbitRepo {
+		repo, err := NewRepo(ddi.URL, "", "device-1", "TargetToken secret", WithStateFile(stateFile))
+		require.NoError(t, err)
+		repo.bootIDFile = bootID
+		return repo
+	}
+
+	repo := newRepo()
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, repo.InstallFinished(context.Background(), &updates[0], nil))
+	require.Len(t, ddi.feedback, 1)
+	assert.Equal(t, executionProceeding, ddi.feedback[0].Status.Execution)
+
+	// The installed action isn't offered again until the reboot
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+	require.NoError(t, repo.BootedVersion(context.Background(), semver.New("1.8.1")))
+	assert.Len(t, ddi.feedback, 1)
+
+	// rauc fell back to the old slot
+	require.NoError(t, os.WriteFile(bootID, []byte("boot-2\n"), 0644))
+	repo = newRepo()
+	require.NoError(t, repo.BootedVersion(context.Background(), semver.New("1.8.1")))
+	require.Len(t, ddi.feedback, 2)
+	assert.Equal(t, executionClosed, ddi.feedback[1].Status.Execution)
+	assert.Equal(t, finishedFailure, ddi.feedback[1].Status.Result.Finished)
+	assert.NoFileExists(t, stateFile)
+
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, repo.InstallFinished(context.Background(), &updates[0], nil))
+	require.NoError(t, os.WriteFile(bootID, []byte("boot-3\n"), 0644))
+	repo = newRepo()
+	require.NoError(t, repo.BootedVersion(context.Background(), semver.New("1.8.2")))
+	require.Len(t, ddi.feedback, 4)
+	assert.Equal(t, executionClosed, ddi.feedback[3].Status.Execution)
+	assert.Equal(t, finishedSuccess, ddi.feedback[3].Status.Result.Finished)
+}
+
+func TestParseSleep(t *testing.T) {
+	sleep, err := parseSleep("01:02:03")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour+2*time.Minute+3*time.Second, sleep)
+
+	_, err = parseSleep("5m")
+	assert.Error(t, err)
+}
@@ -0,0 +1,221 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultMountsFile   = "/proc/self/mounts"
+	defaultPollInterval = 5 * time.Second
+)
+
+// sidecarExtensions are checked in order next to every bundle, i.e. foo_update.bin.json
+var sidecarExtensions = []string{".json", ".yaml", ".yml"}
+
+// Metadata can be placed in a sidecar file next to a bundle if the file name doesn't carry all information
+type Metadata struct {
+	Version     string    `json:"version" yaml:"version"`
+	Name        string    `json:"name" yaml:"name"`
+	Notes       string    `json:"notes" yaml:"notes"`
+	ReleaseDate time.Time `json:"releaseDate" yaml:"releaseDate"`
+	Prerelease  bool      `json:"prerelease" yaml:"prerelease"`
+	Channel     string    `json:"channel" yaml:"channel"`
+	Compatible  string    `json:"compatible" yaml:"compatible"`
+}
+
+// LocalRepo finds update bundles in local directories, i.e. on USB sticks mounted below /media
+type LocalRepo struct {
+	paths        []string
+	mountsFile   string
+	pollInterval time.Duration
+	logger       logrus.FieldLogger
+}
+
+func init() {
+	repository.RegisterBuilder("local", New)
+}
+
+func New(conf *viper.Viper) (repository.Repository, error) {
+	paths := conf.GetStringSlice("paths")
+	repo, err := NewRepo(paths...)
+	if err != nil {
+		return nil, err
+	}
+	if interval := conf.GetDuration("pollInterval"); interval > 0 {
+		repo.pollInterval = interval
+	}
+	return repo, nil
+}
+
+// NewRepo creates a repository scanning the given directories. Paths can be glob patterns like /media/*
+// so that the mount points of removable media don't need to be known in advance.
+func NewRepo(paths ...string) (*LocalRepo, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no paths to scan for update bundles specified")
+	}
+	for _, p := range paths {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %s: %w", p, err)
+		}
+	}
+	return &LocalRepo{
+		paths:        paths,
+		mountsFile:   defaultMountsFile,
+		pollInterval: defaultPollInterval,
+		logger:       logrus.WithFields(logrus.Fields{"repotype": "local", "paths": paths}),
+	}, nil
+}
+
+func (l *LocalRepo) directories() (dirs []string) {
+	for _, pattern := range l.paths {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				dirs = append(dirs, match)
+			}
+		}
+	}
+	return
+}
+
+func (l *LocalRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	logger := l.logger
+	updatesByVersion := make(map[string]*repository.Update)
+
+	for _, dir := range l.directories() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			logger.WithError(err).WithField("dir", dir).Warn("failed to read directory")
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), "_update.bin") {
+				continue
+			}
+			bundlePath := filepath.Join(dir, entry.Name())
+			logger := logger.WithField("bundle", bundlePath)
+			info, err := entry.Info()
+			if err != nil {
+				logger.WithError(err).Warn("failed to stat bundle")
+				continue
+			}
+			meta, err := readMetadata(bundlePath)
+			if err != nil {
+				logger.WithError(err).Error("failed to read sidecar metadata")
+				continue
+			}
+			if meta.Version == "" {
+				meta.Version = repository.VersionFromBundleName(entry.Name())
+			}
+			version, err := repository.VersionFromTag(meta.Version)
+			if err != nil {
+				logger.WithError(err).Error("bundle can't be used because it has no semver version")
+				continue
+			}
+			if meta.ReleaseDate.IsZero() {
+				meta.ReleaseDate = info.ModTime()
+			}
+
+			update, exists := updatesByVersion[version.String()]
+			if !exists {
+				update = &repository.Update{
+					Version:     version,
+					ReleaseDate: meta.ReleaseDate,
+					Name:        meta.Name,
+					Notes:       meta.Notes,
+					Prerelease:  meta.Prerelease || version.PreRelease != "",
+					Channel:     meta.Channel,
+				}
+				updatesByVersion[version.String()] = update
+			}
+			update.Bundles = append(update.Bundles, &repository.BundleLink{
+				URL:           fileURL(bundlePath),
+				AssetName:     entry.Name(),
+				Compatibility: meta.Compatible,
+				Size:          info.Size(),
+			})
+		}
+	}
+
+	for _, update := range updatesByVersion {
+		updates = append(updates, *update)
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Version.LessThan(*updates[j].Version)
+	})
+	return updates, nil
+}
+
+// Watch polls the mount table and calls changed whenever file systems are mounted or unmounted, so that
+// updates on freshly inserted removable media are found without waiting for the next scheduled check.
+func (l *LocalRepo) Watch(ctx context.Context, changed func()) error {
+	lastMounts, err := os.ReadFile(l.mountsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read mount table %s: %w", l.mountsFile, err)
+	}
+	go func() {
+		ticker := time.NewTicker(l.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				mounts, err := os.ReadFile(l.mountsFile)
+				if err != nil {
+					l.logger.WithError(err).Warn("failed to read mount table")
+					continue
+				}
+				if !bytes.Equal(mounts, lastMounts) {
+					lastMounts = mounts
+					l.logger.Info("mount points changed, rescanning for update bundles")
+					changed()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func readMetadata(bundlePath string) (meta Metadata, err error) {
+	for _, ext := range sidecarExtensions {
+		data, err := os.ReadFile(bundlePath + ext)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return meta, err
+		}
+		if ext == ".json" {
+			err = json.Unmarshal(data, &meta)
+		} else {
+			err = yaml.Unmarshal(data, &meta)
+		}
+		return meta, err
+	}
+	return meta, nil
+}
+
+func fileURL(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
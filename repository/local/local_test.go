@@ -0,0 +1,71 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanDirectories(t *testing.T) {
+	mediaDir := t.TempDir()
+	stick1 := filepath.Join(mediaDir, "sda1")
+	stick2 := filepath.Join(mediaDir, "sdb1")
+	require.NoError(t, os.Mkdir(stick1, 0755))
+	require.NoError(t, os.Mkdir(stick2, 0755))
+
+	require.NoError(t, os.WriteFile(filepath.Join(stick1, "cbpifw-raspberrypi3-64_v1.8.2_update.bin"), []byte("bundle"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(stick2, "cbpifw-raspberrypi4-64_v1.8.2_update.bin"), []byte("bundle"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(stick2, "firmware_update.bin"), []byte("bundle"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(stick2, "firmware_update.bin.yaml"), []byte(`
+version: v1.9.0
+name: Walrus
+compatible: cbpifw-raspberrypi3-64
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(stick2, "unversioned_update.bin"), []byte("bundle"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(stick2, "README.txt"), []byte("readme"), 0644))
+
+	repo, err := NewRepo(filepath.Join(mediaDir, "*"))
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	require.Len(t, updates[0].Bundles, 2)
+	assert.Equal(t, "file://"+filepath.Join(stick1, "cbpifw-raspberrypi3-64_v1.8.2_update.bin"), updates[0].Bundles[0].URL)
+	assert.EqualValues(t, 6, updates[0].Bundles[0].Size)
+
+	assert.Equal(t, "1.9.0", updates[1].Version.String())
+	assert.Equal(t, "Walrus", updates[1].Name)
+	require.Len(t, updates[1].Bundles, 1)
+	assert.Equal(t, "cbpifw-raspberrypi3-64", updates[1].Bundles[0].Compatibility)
+}
+
+func TestWatchMountPoints(t *testing.T) {
+	mountsFile := filepath.Join(t.TempDir(), "mounts")
+	require.NoError(t, os.WriteFile(mountsFile, []byte("/dev/root / ext4 rw 0 0\n"), 0644))
+
+	repo, err := NewRepo("/media/*")
+	require.NoError(t, err)
+	repo.mountsFile = mountsFile
+	repo.pollInterval = 10 * time.Millisecond
+
+	changed := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, repo.Watch(ctx, func() {
+		changed <- struct{}{}
+	}))
+
+	require.NoError(t, os.WriteFile(mountsFile, []byte("/dev/root / ext4 rw 0 0\n/dev/sda1 /media/sda1 vfat rw 0 0\n"), 0644))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("mount point change was not detected")
+	}
+}
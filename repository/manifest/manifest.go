@@ -0,0 +1,294 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/dereulenspiegel/raucgithub/repository/signature"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentSchemaVersion is the newest manifest schema version this repository understands
+const CurrentSchemaVersion = 1
+
+var (
+	ErrUnsupportedSchema = errors.New("unsupported manifest schema version")
+	errNotFound          = errors.New("not found")
+)
+
+// maxManifestSize limits how much we read from the server, manifests are expected to be small
+const maxManifestSize = 4 * 1024 * 1024
+
+type header struct {
+	SchemaVersion int `json:"schemaVersion" yaml:"schemaVersion"`
+}
+
+// Manifest describes all available updates in version 1 of the manifest schema. A manifest can be written
+// as JSON or YAML, i.e.
+//
+//	schemaVersion: 1
+//	updates:
+//	  - version: 1.8.2
+//	    name: Penguin
+//	    releaseDate: 2023-01-20T10:00:00Z
+//	    notes: Fixes all the bugs
+//	    prerelease: false
+//	    minimumVersion: 1.6.0
+//	    mandatory: true
+//	    rolloutSchedule:
+//	      - after: 0h
+//	        percentage: 5
+//	      - after: 48h
+//	        percentage: 100
+//	    bundles:
+//	      - url: cbpifw-raspberrypi3-64_v1.8.2_update.bin
+//	        size: 104857600
+//	        compatible: cbpifw-raspberrypi3-64
+//	        sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	yanked:
+//	  - version: 1.8.1
+//	    reason: Breaks the temperature sensor
+//
+// Bundle URLs may be relative to the URL of the manifest.
+type Manifest struct {
+	SchemaVersion int      `json:"schemaVersion" yaml:"schemaVersion"`
+	Updates       []Update `json:"updates" yaml:"updates"`
+	// Yanked lists withdrawn releases, which can stay in the list of updates
+	Yanked []Yanked `json:"yanked" yaml:"yanked"`
+}
+
+type Update struct {
+	Version           string                    `json:"version" yaml:"version"`
+	Name              string                    `json:"name" yaml:"name"`
+	ReleaseDate       time.Time                 `json:"releaseDate" yaml:"releaseDate"`
+	Notes             string                    `json:"notes" yaml:"notes"`
+	Prerelease        bool                      `json:"prerelease" yaml:"prerelease"`
+	Channel           string                    `json:"channel" yaml:"channel"`
+	MinimumVersion    string                    `json:"minimumVersion" yaml:"minimumVersion"`
+	Mandatory         bool                      `json:"mandatory" yaml:"mandatory"`
+	Yanked            bool                      `json:"yanked" yaml:"yanked"`
+	YankReason        string                    `json:"yankReason" yaml:"yankReason"`
+	RolloutPercentage *int                      `json:"rolloutPercentage" yaml:"rolloutPercentage"`
+	RolloutSchedule   []repository.RolloutStage `json:"rolloutSchedule" yaml:"rolloutSchedule"`
+	Bundles           []Bundle                  `json:"bundles" yaml:"bundles"`
+}
+
+type Yanked struct {
+	Version string `json:"version" yaml:"version"`
+	Reason  string `json:"reason" yaml:"reason"`
+}
+
+type Bundle struct {
+	URL        string `json:"url" yaml:"url"`
+	Name       string `json:"name" yaml:"name"`
+	Size       int64  `json:"size" yaml:"size"`
+	Compatible string `json:"compatible" yaml:"compatible"`
+	SHA256     string `json:"sha256" yaml:"sha256"`
+}
+
+// Parse decodes a manifest in either JSON or YAML format and checks that the schema version is supported
+func Parse(data []byte) (*Manifest, error) {
+	unmarshal := yaml.Unmarshal
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		unmarshal = json.Unmarshal
+	}
+	var h header
+	if err := unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if h.SchemaVersion < 1 || h.SchemaVersion > CurrentSchemaVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSchema, h.SchemaVersion)
+	}
+	manifest := &Manifest{}
+	if err := unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+type ManifestRepo struct {
+	client   *http.Client
+	url      *url.URL
+	verifier repository.SignatureVerifier
+	logger   logrus.FieldLogger
+}
+
+type Option func(*ManifestRepo) *ManifestRepo
+
+// WithVerifier requires a detached signature next to the manifest, i.e. manifest.yaml.minisig or manifest.yaml.sig
+func WithVerifier(verifier repository.SignatureVerifier) Option {
+	return func(m *ManifestRepo) *ManifestRepo {
+		m.verifier = verifier
+		return m
+	}
+}
+
+func init() {
+	repository.RegisterBuilder("manifest", New)
+}
+
+func New(conf *viper.Viper) (repository.Repository, error) {
+	manifestURL := conf.GetString("url")
+	var opts []Option
+	if conf.IsSet("publicKeys") || conf.IsSet("publicKeyFiles") {
+		verifier, err := signature.LoadVerifier(conf.GetStringSlice("publicKeys"), conf.GetStringSlice("publicKeyFiles"),
+			conf.GetString("signatureNamespace"))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithVerifier(verifier))
+	}
+	return NewRepo(manifestURL, opts...)
+}
+
+// NewRepo creates a repository serving the updates listed in the manifest at manifestURL
+func NewRepo(manifestURL string, opts ...Option) (*ManifestRepo, error) {
+	if manifestURL == "" {
+		return nil, errors.New("no manifest URL specified")
+	}
+	u, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest URL %s: %w", manifestURL, err)
+	}
+	m := &ManifestRepo{
+		client: http.DefaultClient,
+		url:    u,
+		logger: logrus.WithFields(logrus.Fields{"repotype": "manifest", "url": manifestURL}),
+	}
+	for _, opt := range opts {
+		m = opt(m)
+	}
+	return m, nil
+}
+
+func (m *ManifestRepo) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json, application/yaml;q=0.9, */*;q=0.5")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+}
+
+// verify checks the detached signature of the manifest, which is expected next to it
+func (m *ManifestRepo) verify(ctx context.Context, data []byte) error {
+	_, name := path.Split(m.url.Path)
+	for _, signatureName := range repository.SignatureNames(name) {
+		signatureURL, err := m.url.Parse(signatureName)
+		if err != nil {
+			return err
+		}
+		signature, err := m.fetch(ctx, signatureURL)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load signature from %s: %w", signatureURL, err)
+		}
+		return m.verifier.Verify(data, signature)
+	}
+	return fmt.Errorf("%w: no signature found for manifest %s", repository.ErrMissingSignature, m.url)
+}
+
+func (m *ManifestRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	logger := m.logger
+	data, err := m.fetch(ctx, m.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load manifest from %s: %w", m.url, err)
+	}
+	if m.verifier != nil {
+		if err := m.verify(ctx, data); err != nil {
+			return nil, fmt.Errorf("failed to verify manifest from %s: %w", m.url, err)
+		}
+	}
+	manifest, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest from %s: %w", m.url, err)
+	}
+
+	yanked := make(map[string]string)
+	for _, entry := range manifest.Yanked {
+		version, err := repository.VersionFromTag(entry.Version)
+		if err != nil {
+			logger.WithError(err).WithField("version", entry.Version).Warn("ignoring yanked release with invalid version")
+			continue
+		}
+		yanked[version.String()] = entry.Reason
+	}
+
+	for _, entry := range manifest.Updates {
+		version, err := repository.VersionFromTag(entry.Version)
+		if err != nil {
+			logger.WithError(err).WithField("version", entry.Version).
+				Error("update can't be used because the version is not a semver version")
+			continue
+		}
+		update := repository.Update{
+			Version:           version,
+			ReleaseDate:       entry.ReleaseDate,
+			Name:              entry.Name,
+			Notes:             entry.Notes,
+			Prerelease:        entry.Prerelease,
+			Channel:           entry.Channel,
+			Mandatory:         entry.Mandatory,
+			Yanked:            entry.Yanked || entry.YankReason != "",
+			YankReason:        entry.YankReason,
+			Verified:          m.verifier != nil,
+			RolloutPercentage: entry.RolloutPercentage,
+			RolloutSchedule:   entry.RolloutSchedule,
+		}
+		if err := repository.ValidateRollout(entry.RolloutPercentage, entry.RolloutSchedule); err != nil {
+			logger.WithError(err).WithField("version", entry.Version).Error("update can't be used because of an invalid rollout")
+			continue
+		}
+		if reason, exists := yanked[version.String()]; exists {
+			update.Yanked, update.YankReason = true, reason
+		}
+		if entry.MinimumVersion != "" {
+			if update.MinimumVersion, err = repository.VersionFromTag(entry.MinimumVersion); err != nil {
+				logger.WithError(err).WithField("version", entry.Version).
+					Error("update can't be used because the minimum version is not a semver version")
+				continue
+			}
+		}
+		for _, b := range entry.Bundles {
+			bundleURL, err := m.url.Parse(b.URL)
+			if err != nil {
+				logger.WithError(err).WithField("bundleURL", b.URL).Error("skipping bundle with invalid URL")
+				continue
+			}
+			update.Bundles = append(update.Bundles, &repository.BundleLink{
+				URL:           bundleURL.String(),
+				AssetName:     b.Name,
+				Compatibility: b.Compatible,
+				Size:          b.Size,
+				SHA256:        strings.ToLower(b.SHA256),
+			})
+		}
+		updates = append(updates, update)
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package manifest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const yamlManifest = `
+schemaVersion: 1
+updates:
+  - version: 1.8.2
+    name: Penguin
+    releaseDate: 2023-01-20T10:00:00Z
+    notes: Fixes all the bugs
+    minimumVersion: v1.6.0
+    mandatory: true
+    bundles:
+      - url: bundles/cbpifw-raspberrypi3-64_v1.8.2_update.bin
+        size: 1024
+        compatible: cbpifw-raspberrypi3-64
+  - version: v1.9.0-rc1
+    prerelease: true
+    bundles:
+      - url: https://cdn.example.com/cbpifw-raspberrypi3-64_v1.9.0-rc1_update.bin
+        name: cbpifw-raspberrypi3-64_v1.9.0-rc1_update.bin
+  - version: latest
+yanked:
+  - version: v1.9.0-rc1
+    reason: Wrong partition layout
+`
+
+const jsonManifest = `{
+	"schemaVersion": 1,
+	"updates": [
+		{
+			"version": "1.8.2",
+			"releaseDate": "2023-01-20T10:00:00Z",
+			"rolloutSchedule": [{"after": "0h", "percentage": 5}, {"after": "48h", "percentage": 100}],
+			"bundles": [{"url": "/firmware/cbpifw-raspberrypi3-64_v1.8.2_update.bin"}]
+		}
+	]
+}`
+
+func TestYAMLManifest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(yamlManifest))
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo(srv.URL + "/firmware/manifest.yaml")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	assert.Equal(t, "Penguin", updates[0].Name)
+	assert.Equal(t, 2023, updates[0].ReleaseDate.Year())
+	assert.Equal(t, "1.6.0", updates[0].MinimumVersion.String())
+	assert.True(t, updates[0].Mandatory)
+	require.Len(t, updates[0].Bundles, 1)
+	assert.Equal(t, srv.URL+"/firmware/bundles/cbpifw-raspberrypi3-64_v1.8.2_update.bin", updates[0].Bundles[0].URL)
+	assert.Equal(t, "cbpifw-raspberrypi3-64", updates[0].Bundles[0].Compatibility)
+	assert.EqualValues(t, 1024, updates[0].Bundles[0].Size)
+
+	assert.False(t, updates[0].Yanked)
+	assert.True(t, updates[1].Prerelease)
+	assert.True(t, updates[1].Yanked)
+	assert.Equal(t, "Wrong partition layout", updates[1].YankReason)
+	assert.Equal(t, "https://cdn.example.com/cbpifw-raspberrypi3-64_v1.9.0-rc1_update.bin", updates[1].Bundles[0].URL)
+}
+
+func TestJSONManifest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(jsonManifest))
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo(srv.URL + "/manifest.json")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, srv.URL+"/firmware/cbpifw-raspberrypi3-64_v1.8.2_update.bin", updates[0].Bundles[0].URL)
+	require.Len(t, updates[0].RolloutSchedule, 2)
+	assert.Equal(t, 48*time.Hour, updates[0].RolloutSchedule[1].After)
+}
+
+func TestUnsupportedSchemaVersion(t *testing.T) {
+	_, err := Parse([]byte(`{"schemaVersion": 2, "updates": []}`))
+	assert.ErrorIs(t, err, ErrUnsupportedSchema)
+
+	_, err = Parse([]byte(`updates: []`))
+	assert.ErrorIs(t, err, ErrUnsupportedSchema)
+}
+
+// signatureStub accepts signatures which equal "signed by release key"
+type signatureStub struct{}
+
+func (signatureStub) Verify(message, signature []byte) error {
+	if string(signature) != "signed by release key" {
+		return repository.ErrInvalidSignature
+	}
+	return nil
+}
+
+func TestSignedManifest(t *testing.T) {
+	signature := "signed by release key"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/firmware/manifest.yaml":
+			w.Write([]byte(yamlManifest))
+		case "/firmware/manifest.yaml.sig":
+			if signature == "" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(signature))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	repo, err := NewRepo(srv.URL+"/firmware/manifest.yaml", WithVerifier(signatureStub{}))
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+	assert.True(t, updates[0].Verified)
+
+	signature = "forged"
+	_, err = repo.Updates(context.Background())
+	assert.ErrorIs(t, err, repository.ErrInvalidSignature)
+
+	signature = ""
+	_, err = repo.Updates(context.Background())
+	assert.ErrorIs(t, err, repository.ErrMissingSignature)
+}
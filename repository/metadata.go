@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReleaseMetadata attaches policy to a release. It can be written into the release notes either as YAML front
+// matter or as a fenced rauc-meta block, i.e.
+//
+//	```rauc-meta
+//	minimumVersion: 1.6.0
+//	mandatory: true
+//	critical: true
+//	rolloutPercentage: 20
+//	summary: Fixes the temperature sensor
+//	channel: beta
+//	```
+//
+// Instead of a fixed rolloutPercentage, the share of devices can be raised over time since the release date:
+//
+//	rolloutSchedule:
+//	  - after: 0h
+//	    percentage: 5
+//	  - after: 48h
+//	    percentage: 50
+//	  - after: 168h
+//	    percentage: 100
+//
+// Releases which turn out to be broken can be withdrawn by adding yanked: true and a yankReason.
+type ReleaseMetadata struct {
+	MinimumVersion    string         `yaml:"minimumVersion"`
+	Mandatory         bool           `yaml:"mandatory"`
+	Critical          bool           `yaml:"critical"`
+	RolloutPercentage *int           `yaml:"rolloutPercentage"`
+	RolloutSchedule   []RolloutStage `yaml:"rolloutSchedule"`
+	Summary           string         `yaml:"summary"`
+	Channel           string         `yaml:"channel"`
+	Yanked            bool           `yaml:"yanked"`
+	YankReason        string         `yaml:"yankReason"`
+}
+
+var (
+	frontMatterRegex   = regexp.MustCompile("(?ms)\\A---[ \t]*\n(.*?)^---[ \t]*(\n|\\z)")
+	metadataBlockRegex = regexp.MustCompile("(?ms)^```rauc-meta[ \t]*\n(.*?)^```[ \t]*(\n|\\z)")
+)
+
+// ParseReleaseNotes extracts the release metadata from release notes and returns the notes without it.
+// If the notes contain no metadata, nil and the unmodified notes are returned.
+func ParseReleaseNotes(body string) (meta *ReleaseMetadata, notes string, err error) {
+	// Release notes edited in a browser usually contain windows line endings
+	normalized := strings.ReplaceAll(body, "\r\n", "\n")
+
+	loc := frontMatterRegex.FindStringSubmatchIndex(normalized)
+	if loc == nil {
+		loc = metadataBlockRegex.FindStringSubmatchIndex(normalized)
+	}
+	if loc == nil {
+		return nil, body, nil
+	}
+	block := normalized[loc[2]:loc[3]]
+	notes = normalized[:loc[0]] + normalized[loc[1]:]
+
+	meta = &ReleaseMetadata{}
+	if err := yaml.Unmarshal([]byte(block), meta); err != nil {
+		return nil, body, fmt.Errorf("failed to decode release metadata: %w", err)
+	}
+	return meta, strings.TrimSpace(notes), nil
+}
+
+// Apply copies the metadata onto the update
+func (m *ReleaseMetadata) Apply(update *Update) error {
+	if m.MinimumVersion != "" {
+		minimumVersion, err := VersionFromTag(m.MinimumVersion)
+		if err != nil {
+			return fmt.Errorf("invalid minimum version %s: %w", m.MinimumVersion, err)
+		}
+		update.MinimumVersion = minimumVersion
+	}
+	if err := ValidateRollout(m.RolloutPercentage, m.RolloutSchedule); err != nil {
+		return err
+	}
+	update.Mandatory = m.Mandatory
+	update.Yanked = m.Yanked || m.YankReason != ""
+	update.YankReason = m.YankReason
+	update.Critical = m.Critical
+	update.RolloutPercentage = m.RolloutPercentage
+	update.RolloutSchedule = m.RolloutSchedule
+	update.Summary = m.Summary
+	if m.Channel != "" {
+		update.Channel = m.Channel
+	}
+	return nil
+}
+
+// SetReleaseNotes sets the notes of the update and applies the release metadata contained in them.
+// If the metadata is invalid, the notes are used verbatim and the error is returned.
+func (u *Update) SetReleaseNotes(body string) error {
+	u.Notes = body
+	meta, notes, err := ParseReleaseNotes(body)
+	if err != nil || meta == nil {
+		return err
+	}
+	applied := *u
+	if err := meta.Apply(&applied); err != nil {
+		return err
+	}
+	applied.Notes = notes
+	*u = applied
+	return nil
+}
@@ -0,0 +1,292 @@
+package multi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Source is a repository with a priority. Updates and bundles from sources with a higher priority are preferred.
+type Source struct {
+	Name     string
+	Priority int
+	Repo     repository.Repository
+}
+
+// MultiRepo merges the updates of several repositories into one list
+type MultiRepo struct {
+	// Feedback about an update is passed through to the source it originates from
+	repository.Wrapper
+	sources []Source
+	logger  logrus.FieldLogger
+
+	originsLock sync.Mutex
+	// origins remembers which source provided the metadata of an update, so feedback reaches the right repository
+	origins map[string]repository.Repository
+}
+
+func init() {
+	repository.RegisterBuilder("multi", New)
+}
+
+// New creates all repositories listed under sources, each with its own type, priority and configuration, i.e.
+//
+//	sources:
+//	  - type: local
+//	    priority: 20
+//	    paths: [/media/*]
+//	  - type: github
+//	    priority: 10
+//	    owner: dereulenspiegel
+//	    repo: firmware_craftbeerpi
+//
+// Repositories which can't be created are skipped, so one misconfigured source doesn't disable all updates.
+func New(conf *viper.Viper) (repository.Repository, error) {
+	entries, ok := conf.Get("sources").([]interface{})
+	if !ok {
+		return nil, errors.New("sources needs to be a list of repositories")
+	}
+	logger := logrus.WithField("repotype", "multi")
+	var sources []Source
+	for i, entry := range entries {
+		entryMap, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("source %d is not a map", i)
+		}
+		sourceConf := viper.New()
+		if err := sourceConf.MergeConfigMap(entryMap); err != nil {
+			return nil, fmt.Errorf("invalid configuration of source %d: %w", i, err)
+		}
+		repoType := sourceConf.GetString("type")
+		name := sourceConf.GetString("name")
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", repoType, i)
+		}
+		logger := logger.WithFields(logrus.Fields{"source": name, "type": repoType})
+		newRepository, exists := repository.Builder(repoType)
+		if !exists {
+			logger.Error("unknown repository type")
+			continue
+		}
+		repo, err := newRepository(sourceConf)
+		if err != nil {
+			logger.WithError(err).Error("failed to create repository")
+			continue
+		}
+		sources = append(sources, Source{Name: name, Priority: sourceConf.GetInt("priority"), Repo: repo})
+	}
+	return NewRepo(sources...)
+}
+
+func NewRepo(sources ...Source) (*MultiRepo, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no repositories to aggregate")
+	}
+	sorted := append([]Source{}, sources...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	m := &MultiRepo{
+		sources: sorted,
+		logger:  logrus.WithField("repotype", "multi"),
+		origins: make(map[string]repository.Repository),
+	}
+	m.Wrapper = repository.WrapRouted(m.origin)
+	return m, nil
+}
+
+// origin returns the source which provided the metadata of an update
+func (m *MultiRepo) origin(update *repository.Update) repository.Repository {
+	if update == nil {
+		return nil
+	}
+	m.originsLock.Lock()
+	defer m.originsLock.Unlock()
+	return m.origins[update.Version.String()]
+}
+
+type sourceResult struct {
+	updates []repository.Update
+	err     error
+}
+
+// Updates queries all sources concurrently. Updates with the same version are merged, the metadata is taken
+// from the source with the highest priority and bundles of lower priority sources are added if no bundle
+// with the same asset name exists yet, otherwise they are used as mirrors of the existing bundle. Failing sources
+// are skipped and reported with a repository.PartialError, only if all sources fail no updates are returned.
+func (m *MultiRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	results := make([]sourceResult, len(m.sources))
+	wg := &sync.WaitGroup{}
+	for i, source := range m.sources {
+		wg.Add(1)
+		go func(i int, source Source) {
+			defer wg.Done()
+			updates, err := source.Repo.Updates(ctx)
+			results[i] = sourceResult{updates: updates, err: err}
+		}(i, source)
+	}
+	wg.Wait()
+
+	var failures []error
+	failed := 0
+	var merged []*repository.Update
+	byVersion := make(map[string]*repository.Update)
+	origins := make(map[string]repository.Repository)
+	for i, result := range results {
+		source := m.sources[i]
+		if result.err != nil {
+			m.logger.WithError(result.err).WithField("source", source.Name).Warn("failed to query repository")
+			failures = append(failures, fmt.Errorf("%s: %w", source.Name, result.err))
+			if !repository.IsPartial(result.err) {
+				failed++
+				continue
+			}
+		}
+		for _, update := range result.updates {
+			key := update.Version.String()
+			existing, exists := byVersion[key]
+			if !exists {
+				update := update
+				update.Bundles = append([]*repository.BundleLink{}, update.Bundles...)
+				byVersion[key] = &update
+				origins[key] = source.Repo
+				merged = append(merged, &update)
+				continue
+			}
+			if update.Yanked && !existing.Yanked {
+				// A release withdrawn in one source must not be installed from another one
+				existing.Yanked, existing.YankReason = true, update.YankReason
+			}
+			for _, bundle := range update.Bundles {
+				if idx := assetIndex(existing, bundle.AssetName); idx >= 0 {
+					existing.Bundles[idx] = withMirror(existing.Bundles[idx], bundle)
+				} else if existing.Verified && !update.Verified {
+					// The hashes of verified updates are trusted without checking any signature, so
+					// unverified bundles can't be added to them
+					m.logger.WithFields(logrus.Fields{
+						"source":        source.Name,
+						"updateVersion": key,
+						"bundleURL":     bundle.URL,
+					}).Warn("skipping unverified bundle of verified update")
+				} else {
+					existing.Bundles = append(existing.Bundles, bundle)
+				}
+			}
+		}
+	}
+	if failed == len(m.sources) {
+		return nil, &sourcesError{errs: failures}
+	}
+
+	m.originsLock.Lock()
+	m.origins = origins
+	m.originsLock.Unlock()
+
+	for _, update := range merged {
+		updates = append(updates, *update)
+	}
+	if len(failures) > 0 {
+		return updates, &repository.PartialError{Errs: failures}
+	}
+	return updates, nil
+}
+
+// sourcesError is returned if all sources failed. Like repository.PartialError it matches the errors of all
+// sources, so i.e. signature errors of a single source are still reported.
+type sourcesError struct {
+	errs []error
+}
+
+func (e *sourcesError) Error() string {
+	msgs := make([]string, 0, len(e.errs))
+	for _, err := range e.errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "all repositories failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *sourcesError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func assetIndex(update *repository.Update, assetName string) int {
+	if assetName == "" {
+		return -1
+	}
+	for i, bundle := range update.Bundles {
+		if bundle.AssetName == assetName {
+			return i
+		}
+	}
+	return -1
+}
+
+// withMirror returns a copy of bundle which falls back to the locations of mirror. Mirrors which need
+// additional headers can't be used, as headers are only sent to the primary URL.
+func withMirror(bundle, mirror *repository.BundleLink) *repository.BundleLink {
+	if len(mirror.Header) > 0 {
+		return bundle
+	}
+	merged := *bundle
+	merged.Mirrors = append(append(append([]string{}, bundle.Mirrors...), mirror.URL), mirror.Mirrors...)
+	return &merged
+}
+
+// Watch watches all sources which support it. A source which can't be watched is skipped, only if no source
+// can be watched an error is returned.
+func (m *MultiRepo) Watch(ctx context.Context, changed func()) error {
+	var lastErr error
+	watching := 0
+	for _, source := range m.sources {
+		if watcher, ok := source.Repo.(repository.Watcher); ok {
+			if err := watcher.Watch(ctx, changed); err != nil {
+				m.logger.WithError(err).WithField("source", source.Name).Warn("failed to watch repository")
+				lastErr = fmt.Errorf("failed to watch repository %s: %w", source.Name, err)
+				continue
+			}
+			watching++
+		}
+	}
+	if watching == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// BootedVersion is passed to all sources, as the version might have been installed from any of them
+func (m *MultiRepo) BootedVersion(ctx context.Context, version *semver.Version) (err error) {
+	for _, source := range m.sources {
+		if reporter, ok := source.Repo.(repository.BootReporter); ok {
+			if reportErr := reporter.BootedVersion(ctx, version); reportErr != nil {
+				err = fmt.Errorf("failed to report booted version to %s: %w", source.Name, reportErr)
+			}
+		}
+	}
+	return err
+}
+
+// RepositoryStatus merges the status of all sources, the keys are prefixed with the name of the source
+func (m *MultiRepo) RepositoryStatus() map[string]string {
+	status := make(map[string]string)
+	for _, source := range m.sources {
+		if reporter, ok := source.Repo.(repository.StatusReporter); ok {
+			for key, value := range reporter.RepositoryStatus() {
+				status[source.Name+"."+key] = value
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,172 @@
+package multi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/mocks"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeUpdates(t *testing.T) {
+	github := mocks.NewRepository(t)
+	usb := mocks.NewRepository(t)
+	mirror := mocks.NewRepository(t)
+
+	github.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:    "Penguin from GitHub",
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://github.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin", AssetName: "cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+				{URL: "https://github.com/cbpifw-raspberrypi4-64_v1.8.2_update.bin", AssetName: "cbpifw-raspberrypi4-64_v1.8.2_update.bin"},
+			},
+		},
+		{
+			Version: semver.New("1.9.0"),
+		},
+	}, nil)
+	usb.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Name:    "Penguin from USB",
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{URL: "file:///media/sda1/cbpifw-raspberrypi3-64_v1.8.2_update.bin", AssetName: "cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+			},
+		},
+	}, nil)
+	mirror.EXPECT().Updates(mock.Anything).Return(nil, errors.New("mirror unreachable"))
+
+	repo, err := NewRepo(
+		Source{Name: "github", Priority: 10, Repo: github},
+		Source{Name: "mirror", Priority: 15, Repo: mirror},
+		Source{Name: "usb", Priority: 20, Repo: usb},
+	)
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	// The failing mirror is reported, so the incomplete result isn't cached
+	require.True(t, repository.IsPartial(err))
+	require.Len(t, updates, 2)
+
+	assert.Equal(t, "Penguin from USB", updates[0].Name)
+	require.Len(t, updates[0].Bundles, 2)
+	assert.Equal(t, "file:///media/sda1/cbpifw-raspberrypi3-64_v1.8.2_update.bin", updates[0].Bundles[0].URL)
+	assert.Equal(t, []string{"https://github.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"}, updates[0].Bundles[0].Mirrors)
+	assert.Equal(t, "https://github.com/cbpifw-raspberrypi4-64_v1.8.2_update.bin", updates[0].Bundles[1].URL)
+	assert.Equal(t, "1.9.0", updates[1].Version.String())
+}
+
+func TestKeepUnverifiedBundlesOutOfVerifiedUpdates(t *testing.T) {
+	manifest := mocks.NewRepository(t)
+	github := mocks.NewRepository(t)
+	manifest.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Version:  semver.New("1.8.2"),
+			Verified: true,
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin", AssetName: "cbpifw-raspberrypi3-64_v1.8.2_update.bin", SHA256: "abcd"},
+			},
+		},
+	}, nil)
+	github.EXPECT().Updates(mock.Anything).Return([]repository.Update{
+		{
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://github.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin", AssetName: "cbpifw-raspberrypi3-64_v1.8.2_update.bin"},
+				{URL: "https://github.com/cbpifw-raspberrypi4-64_v1.8.2_update.bin", AssetName: "cbpifw-raspberrypi4-64_v1.8.2_update.bin", SHA256: "ef01"},
+			},
+		},
+	}, nil)
+
+	repo, err := NewRepo(
+		Source{Name: "github", Priority: 10, Repo: github},
+		Source{Name: "manifest", Priority: 20, Repo: manifest},
+	)
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.True(t, updates[0].Verified)
+	require.Len(t, updates[0].Bundles, 1)
+	assert.Equal(t, "abcd", updates[0].Bundles[0].SHA256)
+	assert.Equal(t, []string{"https://github.com/cbpifw-raspberrypi3-64_v1.8.2_update.bin"}, updates[0].Bundles[0].Mirrors)
+}
+
+func TestAllSourcesFail(t *testing.T) {
+	github := mocks.NewRepository(t)
+	usb := mocks.NewRepository(t)
+	github.EXPECT().Updates(mock.Anything).Return(nil, errors.New("rate limited"))
+	usb.EXPECT().Updates(mock.Anything).Return(nil, errors.New("no media"))
+
+	repo, err := NewRepo(Source{Name: "github", Repo: github}, Source{Name: "usb", Repo: usb})
+	require.NoError(t, err)
+	_, err = repo.Updates(context.Background())
+	assert.Error(t, err)
+}
+
+type watchingRepo struct {
+	*mocks.Repository
+	err     error
+	watched bool
+}
+
+func (w *watchingRepo) Watch(ctx context.Context, changed func()) error {
+	w.watched = true
+	return w.err
+}
+
+func TestWatchSkipsFailingSources(t *testing.T) {
+	broken := &watchingRepo{Repository: mocks.NewRepository(t), err: errors.New("udev unavailable")}
+	usb := &watchingRepo{Repository: mocks.NewRepository(t)}
+
+	repo, err := NewRepo(Source{Name: "broken", Priority: 20, Repo: broken}, Source{Name: "usb", Priority: 10, Repo: usb})
+	require.NoError(t, err)
+	require.NoError(t, repo.Watch(context.Background(), func() {}))
+	assert.True(t, usb.watched)
+
+	repo, err = NewRepo(Source{Name: "broken", Repo: broken})
+	require.NoError(t, err)
+	assert.Error(t, repo.Watch(context.Background(), func() {}))
+}
+
+type statusRepo struct {
+	*mocks.Repository
+}
+
+func (statusRepo) RepositoryStatus() map[string]string {
+	return map[string]string{"rateLimitRemaining": "42"}
+}
+
+func TestRepositoryStatus(t *testing.T) {
+	repo, err := NewRepo(
+		Source{Name: "github", Repo: statusRepo{mocks.NewRepository(t)}},
+		Source{Name: "usb", Repo: mocks.NewRepository(t)},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"github.rateLimitRemaining": "42"}, repo.RepositoryStatus())
+}
+
+func TestReportSignatureErrorsOfSources(t *testing.T) {
+	github := mocks.NewRepository(t)
+	manifest := mocks.NewRepository(t)
+	github.EXPECT().Updates(mock.Anything).Return([]repository.Update{{Version: semver.New("1.8.2")}}, nil).Once()
+	manifest.EXPECT().Updates(mock.Anything).Return(nil, fmt.Errorf("failed to verify manifest: %w", repository.ErrInvalidSignature))
+
+	repo, err := NewRepo(Source{Name: "github", Repo: github}, Source{Name: "manifest", Repo: manifest})
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	assert.Len(t, updates, 1)
+	assert.True(t, repository.IsPartial(err))
+	assert.ErrorIs(t, err, repository.ErrInvalidSignature)
+
+	github.EXPECT().Updates(mock.Anything).Return(nil, errors.New("rate limited")).Once()
+	_, err = repo.Updates(context.Background())
+	assert.False(t, repository.IsPartial(err))
+	assert.ErrorIs(t, err, repository.ErrInvalidSignature)
+}
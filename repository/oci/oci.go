@@ -0,0 +1,364 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// MediaTypeBundle is the media type of layers which contain a RAUC bundle
+	MediaTypeBundle = "application/vnd.rauc.bundle"
+	// AnnotationCompatible carries the rauc compatible string of a bundle layer
+	AnnotationCompatible = "io.rauc.compatible"
+
+	annotationTitle       = "org.opencontainers.image.title"
+	annotationCreated     = "org.opencontainers.image.created"
+	annotationDescription = "org.opencontainers.image.description"
+
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+)
+
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Layers        []descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations"`
+}
+
+// OCIRepo finds RAUC bundles stored as OCI artifacts in a registry. Every tag is a version and every layer
+// with the bundle media type is a bundle, annotated with its compatible string and file name.
+type OCIRepo struct {
+	client     *http.Client
+	registry   *url.URL
+	repository string
+	username   string
+	password   string
+	logger     logrus.FieldLogger
+
+	tokenLock sync.Mutex
+	token     string
+}
+
+func init() {
+	repository.RegisterBuilder("oci", New)
+}
+
+func New(conf *viper.Viper) (repository.Repository, error) {
+	registry := conf.GetString("registry")
+	repo := conf.GetString("repository")
+	r, err := NewRepo(registry, repo)
+	if err != nil {
+		return nil, err
+	}
+	r.username = conf.GetString("username")
+	r.password = conf.GetString("password")
+	return r, nil
+}
+
+// NewRepo creates a repository for the artifacts in repo on the registry at registryURL, i.e.
+// https://registry.example.com and firmware/craftbeerpi
+func NewRepo(registryURL, repo string) (*OCIRepo, error) {
+	if registryURL == "" || repo == "" {
+		return nil, errors.New("registry and repository need to be specified")
+	}
+	if !strings.Contains(registryURL, "://") {
+		registryURL = "https://" + registryURL
+	}
+	registry, err := url.Parse(strings.TrimSuffix(registryURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry URL %s: %w", registryURL, err)
+	}
+	return &OCIRepo{
+		client:     http.DefaultClient,
+		registry:   registry,
+		repository: repo,
+		logger:     logrus.WithFields(logrus.Fields{"repotype": "oci", "registry": registryURL, "repository": repo}),
+	}, nil
+}
+
+func (o *OCIRepo) url(format string, args ...interface{}) string {
+	return o.registry.String() + fmt.Sprintf(format, args...)
+}
+
+func (o *OCIRepo) get(ctx context.Context, reqURL, accept string, v interface{}) (*http.Response, error) {
+	resp, err := o.do(ctx, http.MethodGet, reqURL, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s for %s", resp.Status, reqURL)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, fmt.Errorf("failed to decode response of %s: %w", reqURL, err)
+	}
+	return resp, nil
+}
+
+// do sends an authenticated request and fetches a new token if the registry rejects the current one
+func (o *OCIRepo) do(ctx context.Context, method, reqURL, accept string) (*http.Response, error) {
+	resp, err := o.send(ctx, method, reqURL, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := o.authenticate(ctx, challenge); err != nil {
+			return nil, fmt.Errorf("failed to authenticate against registry: %w", err)
+		}
+		return o.send(ctx, method, reqURL, accept)
+	}
+	return resp, nil
+}
+
+func (o *OCIRepo) send(ctx context.Context, method, reqURL, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	for key, values := range o.authHeader() {
+		req.Header[key] = values
+	}
+	return o.client.Do(req)
+}
+
+// authHeader returns the credentials for requests to the registry, nil if the registry allows anonymous access
+func (o *OCIRepo) authHeader() http.Header {
+	o.tokenLock.Lock()
+	token := o.token
+	o.tokenLock.Unlock()
+	if token != "" {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	} else if o.username != "" {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(o.username, o.password)
+		return req.Header
+	}
+	return nil
+}
+
+// BundleHeader returns the credentials to download a blob of the registry. Tokens expire after a few minutes,
+// so they are checked against the blob and refreshed right before the download instead of being stored in the bundle.
+func (o *OCIRepo) BundleHeader(ctx context.Context, update *repository.Update, bundle *repository.BundleLink) (http.Header, error) {
+	if !strings.HasPrefix(bundle.URL, o.registry.String()+"/") {
+		return nil, nil
+	}
+	resp, err := o.do(ctx, http.MethodHead, bundle.URL, MediaTypeBundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authorize download of %s: %w", bundle.URL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s for %s", resp.Status, bundle.URL)
+	}
+	return o.authHeader(), nil
+}
+
+// authenticate implements the token authentication of the distribution spec. Registries like Docker Hub or
+// GHCR require a token even for anonymous pulls.
+func (o *OCIRepo) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return fmt.Errorf("unsupported authentication challenge: %s", challenge)
+	}
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("invalid token realm %s: %w", params["realm"], err)
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", o.repository)
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if o.username != "" {
+		req.SetBasicAuth(o.username, o.password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from token endpoint", resp.Status)
+	}
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return fmt.Errorf("failed to decode token response: %w", err)
+	}
+	token := tokenResponse.Token
+	if token == "" {
+		token = tokenResponse.AccessToken
+	}
+	if token == "" {
+		return errors.New("token endpoint returned no token")
+	}
+	o.tokenLock.Lock()
+	o.token = token
+	o.tokenLock.Unlock()
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header. Quoted values may contain commas, i.e.
+// scope="repository:foo:pull,push".
+func parseChallenge(challenge string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	for rest != "" {
+		var key string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			rest = rest[1:]
+			for len(rest) > 0 && rest[0] != '"' {
+				if rest[0] == '\\' && len(rest) > 1 {
+					rest = rest[1:]
+				}
+				value.WriteByte(rest[0])
+				rest = rest[1:]
+			}
+			rest = strings.TrimPrefix(rest, `"`)
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			rest = rest[end:]
+		}
+		// Skip whatever follows the value up to the next parameter
+		if idx := strings.Index(rest, ","); idx >= 0 {
+			rest = rest[idx+1:]
+		} else {
+			rest = ""
+		}
+		if key = strings.TrimSpace(key); key != "" {
+			params[strings.ToLower(key)] = value.String()
+		}
+	}
+	return
+}
+
+func (o *OCIRepo) tags(ctx context.Context) (tags []string, err error) {
+	nextURL := o.url("/v2/%s/tags/list", o.repository)
+	for nextURL != "" {
+		var list tagList
+		resp, err := o.get(ctx, nextURL, "application/json", &list)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, list.Tags...)
+		nextURL = ""
+		// Registries paginate via a Link header, i.e. </v2/foo/tags/list?n=100&last=bar>; rel="next"
+		if link := resp.Header.Get("Link"); link != "" {
+			target := strings.TrimPrefix(strings.SplitN(link, ";", 2)[0], "<")
+			target = strings.TrimSuffix(target, ">")
+			if next, err := o.registry.Parse(target); err == nil {
+				nextURL = next.String()
+			}
+		}
+	}
+	return tags, nil
+}
+
+func (o *OCIRepo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	logger := o.logger
+	tags, err := o.tags(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags of %s: %w", o.repository, err)
+	}
+
+	for _, tag := range tags {
+		logger := logger.WithField("tag", tag)
+		version, err := repository.VersionFromTag(tag)
+		if err != nil {
+			// Tags like latest are common in registries, so this is not worth an error
+			logger.WithError(err).Debug("ignoring tag which is not a semver version")
+			continue
+		}
+		var m manifest
+		if _, err := o.get(ctx, o.url("/v2/%s/manifests/%s", o.repository, tag), mediaTypeOCIManifest, &m); err != nil {
+			logger.WithError(err).Error("failed to load manifest")
+			continue
+		}
+
+		update := repository.Update{
+			Version:    version,
+			Name:       tag,
+			Notes:      m.Annotations[annotationDescription],
+			Prerelease: version.PreRelease != "",
+		}
+		if created, err := time.Parse(time.RFC3339, m.Annotations[annotationCreated]); err == nil {
+			update.ReleaseDate = created
+		}
+		for _, layer := range m.Layers {
+			if layer.MediaType != MediaTypeBundle {
+				continue
+			}
+			compatible := layer.Annotations[AnnotationCompatible]
+			assetName := layer.Annotations[annotationTitle]
+			if assetName == "" {
+				if compatible == "" {
+					logger.WithField("digest", layer.Digest).
+						Warn("ignoring bundle layer without title and compatible annotation")
+					continue
+				}
+				// The media type already marks the layer as a bundle, the name only has to be recognized as one
+				assetName = fmt.Sprintf("%s_%s_update.bin", compatible, tag)
+				logger.WithField("digest", layer.Digest).Debugf("bundle layer has no title, naming it %s", assetName)
+			}
+			// The credentials are added by BundleHeader right before the download
+			bundle := &repository.BundleLink{
+				URL:           o.url("/v2/%s/blobs/%s", o.repository, layer.Digest),
+				AssetName:     assetName,
+				Compatibility: compatible,
+				Size:          layer.Size,
+			}
+			// Blobs are content addressed, so a sha256 digest is the checksum of the bundle
+			if algorithm, hash, _ := strings.Cut(layer.Digest, ":"); algorithm == "sha256" {
+				bundle.SHA256 = hash
+			}
+			update.Bundles = append(update.Bundles, bundle)
+		}
+		updates = append(updates, update)
+	}
+	return updates, nil
+}
@@ -0,0 +1,178 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry serves a minimal subset of the distribution API and requires token authentication
+func fakeRegistry(t *testing.T) *httptest.Server {
+	manifests := map[string]manifest{
+		"v1.8.2": {
+			SchemaVersion: 2,
+			MediaType:     mediaTypeOCIManifest,
+			Annotations: map[string]string{
+				annotationCreated:     "2023-01-20T10:00:00Z",
+				annotationDescription: "Some notes",
+			},
+			Layers: []descriptor{
+				{
+					MediaType: MediaTypeBundle,
+					Digest:    "sha256:1111",
+					Size:      1024,
+					Annotations: map[string]string{
+						annotationTitle:      "cbpifw-raspberrypi3-64_v1.8.2_update.bin",
+						AnnotationCompatible: "cbpifw-raspberrypi3-64",
+					},
+				},
+				{
+					MediaType: MediaTypeBundle,
+					Digest:    "sha512:3333",
+					Annotations: map[string]string{
+						annotationTitle:      "cbpifw-raspberrypi4-64_v1.8.2_update.bin",
+						AnnotationCompatible: "cbpifw-raspberrypi4-64",
+					},
+				},
+				{
+					MediaType: MediaTypeBundle,
+					Digest:    "sha256:4444",
+					Annotations: map[string]string{
+						AnnotationCompatible: "cbpifw-raspberrypi5-64",
+					},
+				},
+				{
+					MediaType: MediaTypeBundle,
+					Digest:    "sha256:5555",
+				},
+				{
+					MediaType: "application/vnd.oci.image.layer.v1.tar",
+					Digest:    "sha256:2222",
+				},
+			},
+		},
+		"1.9.0-rc1": {
+			SchemaVersion: 2,
+			MediaType:     mediaTypeOCIManifest,
+		},
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			assert.Equal(t, "repository:firmware/craftbeerpi:pull", r.URL.Query().Get("scope"))
+			json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="registry.test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/firmware/craftbeerpi/tags/list":
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</v2/firmware/craftbeerpi/tags/list?n=2&last=v1.8.2>; rel="next"`)
+				json.NewEncoder(w).Encode(tagList{Tags: []string{"latest", "v1.8.2"}})
+				return
+			}
+			json.NewEncoder(w).Encode(tagList{Tags: []string{"1.9.0-rc1"}})
+		case "/v2/firmware/craftbeerpi/manifests/v1.8.2":
+			json.NewEncoder(w).Encode(manifests["v1.8.2"])
+		case "/v2/firmware/craftbeerpi/manifests/1.9.0-rc1":
+			json.NewEncoder(w).Encode(manifests["1.9.0-rc1"])
+		case "/v2/firmware/craftbeerpi/blobs/sha256:1111":
+			w.Write([]byte("rauc bundle"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestListArtifacts(t *testing.T) {
+	srv := fakeRegistry(t)
+
+	repo, err := NewRepo(srv.URL, "firmware/craftbeerpi")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 2)
+
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	assert.Equal(t, "Some notes", updates[0].Notes)
+	assert.Equal(t, 2023, updates[0].ReleaseDate.Year())
+	require.Len(t, updates[0].Bundles, 3)
+	bundle := updates[0].Bundles[0]
+	assert.Equal(t, srv.URL+"/v2/firmware/craftbeerpi/blobs/sha256:1111", bundle.URL)
+	assert.Equal(t, "cbpifw-raspberrypi3-64_v1.8.2_update.bin", bundle.AssetName)
+	assert.Equal(t, "cbpifw-raspberrypi3-64", bundle.Compatibility)
+	assert.EqualValues(t, 1024, bundle.Size)
+	assert.Equal(t, "1111", bundle.SHA256)
+	// Only sha256 digests are checksums rauc bundles can be verified with
+	assert.Empty(t, updates[0].Bundles[1].SHA256)
+	// Layers without a title are named after their compatible, layers without both can't be used
+	assert.Equal(t, "cbpifw-raspberrypi5-64_v1.8.2_update.bin", updates[0].Bundles[2].AssetName)
+	assert.Equal(t, "cbpifw-raspberrypi5-64", updates[0].Bundles[2].Compatibility)
+
+	assert.Equal(t, "1.9.0-rc1", updates[1].Version.String())
+	assert.True(t, updates[1].Prerelease)
+	assert.Empty(t, updates[1].Bundles)
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo:pull"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, "https://auth.example.com/token", params["realm"])
+	assert.Equal(t, "registry.example.com", params["service"])
+	assert.Equal(t, "repository:foo:pull", params["scope"])
+}
+
+func TestDownloadBundleWithToken(t *testing.T) {
+	srv := fakeRegistry(t)
+
+	repo, err := NewRepo(srv.URL, "firmware/craftbeerpi")
+	require.NoError(t, err)
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	bundle := updates[0].Bundles[0]
+	assert.Nil(t, bundle.Header, "short-lived tokens must not be stored with the bundle")
+
+	resp, err := http.Get(bundle.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The token expired between listing and installing the update
+	repo.token = "expired"
+	header, err := repo.BundleHeader(context.Background(), &updates[0], bundle)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+
+	req, err := http.NewRequest(http.MethodGet, bundle.URL, nil)
+	require.NoError(t, err)
+	req.Header = header
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	content, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "rauc bundle", string(content))
+}
+
+func TestParseChallengeWithQuotedCommas(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token", scope="repository:foo:pull,push",service=registry.example.com, error="insufficient_scope"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, "https://auth.example.com/token", params["realm"])
+	assert.Equal(t, "repository:foo:pull,push", params["scope"])
+	assert.Equal(t, "registry.example.com", params["service"])
+	assert.Equal(t, "insufficient_scope", params["error"])
+}
@@ -2,6 +2,13 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/go-semver/semver"
@@ -9,12 +16,36 @@ import (
 )
 
 type Update struct {
+	// ID optionally identifies the update within the repository, i.e. a deployment action
+	ID          string
 	Version     *semver.Version
 	ReleaseDate time.Time
 	Name        string
 	Notes       string
 	Bundles     []*BundleLink
 	Prerelease  bool
+	// Channel is the channel the update is published on if the repository knows it, see ChannelOf
+	Channel string
+
+	// MinimumVersion is the oldest version this update can be installed on, nil if there is no restriction
+	MinimumVersion *semver.Version
+	// Mandatory marks stepping stones, which can't be skipped by devices updating to a newer version
+	Mandatory bool
+	// Yanked marks withdrawn releases, which are never offered but still listed, so devices running them notice
+	Yanked     bool
+	YankReason string
+	// Critical marks updates which should be installed as soon as possible
+	Critical bool
+	// RolloutPercentage limits the update to a share of all devices, nil if the update is meant for all devices
+	RolloutPercentage *int
+	// RolloutSchedule raises the share of devices receiving the update over time, see RolloutPercentageAt
+	RolloutSchedule []RolloutStage
+	// Summary is a short human readable description of the update
+	Summary string
+	// Verified is set by repositories which verified a signature over the metadata of the update, including
+	// the checksums of its bundles, i.e. a signed manifest or TUF metadata. Unverified bundles and checksums must
+	// never be added to verified updates.
+	Verified bool
 }
 
 type BundleLink struct {
@@ -22,10 +53,198 @@ type BundleLink struct {
 	AssetName     string
 	Compatibility string
 	Size          int64
+	// Header contains additional headers necessary to download the bundle, i.e. for authentication
+	Header http.Header
+	// SHA256 is the hex encoded SHA256 hash of the bundle, if it is known
+	SHA256 string
+	// Mirrors are alternative URLs of the same bundle, which are tried in order if the bundle can't be fetched
+	// from URL. Header is only sent to URL, not to the mirrors.
+	Mirrors []string
 }
 
 type Repository interface {
 	Updates(ctx context.Context) ([]Update, error)
 }
 
+// Watcher is implemented by repositories which notice changes on their own, i.e. when removable media
+// containing update bundles is mounted. Watch must not block and calls changed whenever updates might have changed.
+type Watcher interface {
+	Watch(ctx context.Context, changed func()) error
+}
+
+// InstallReporter is implemented by repositories which want to receive feedback about the installation
+// of their updates, i.e. to report the state of a deployment back to a management server
+type InstallReporter interface {
+	InstallStarted(ctx context.Context, update *Update) error
+	InstallProgress(ctx context.Context, update *Update, percentage int32) error
+	InstallFinished(ctx context.Context, update *Update, err error) error
+}
+
+// StatusReporter is implemented by repositories which can report details about their state, i.e. the remaining
+// API rate limit. The status is meant for diagnostics and the keys differ between repositories.
+type StatusReporter interface {
+	RepositoryStatus() map[string]string
+}
+
+// UpdateRejecter is implemented by repositories which need to know about updates the manager decided not to
+// install, i.e. to close the deployment action on a management server
+type UpdateRejecter interface {
+	UpdateRejected(ctx context.Context, update *Update, reason error) error
+}
+
+// BootReporter is implemented by repositories which report the result of an installation only once the device
+// booted the new version. BootedVersion is called with the running version before updates are checked.
+type BootReporter interface {
+	BootedVersion(ctx context.Context, version *semver.Version) error
+}
+
+// BundleAuthorizer is implemented by repositories whose bundles need short-lived credentials, i.e. registry tokens.
+// The manager asks for the header right before a bundle is fetched, so the credentials can't expire between
+// listing and installing the update. A nil header leaves BundleLink.Header in place.
+type BundleAuthorizer interface {
+	BundleHeader(ctx context.Context, update *Update, bundle *BundleLink) (http.Header, error)
+}
+
+// ErrAlreadyInstalled is passed to UpdateRejecter for updates with the currently booted version
+var ErrAlreadyInstalled = errors.New("version is already installed")
+
+// PartialError is returned together with the updates of the sources which could be queried, if other sources
+// failed. The updates can be used, but must not replace a complete result, i.e. in a cache.
+type PartialError struct {
+	Errs []error
+}
+
+func (e *PartialError) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "some repositories failed: " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether the error of any failed source matches target
+func (e *PartialError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPartial returns true if err only reports that some sources failed, so the returned updates can be used
+func IsPartial(err error) bool {
+	var partial *PartialError
+	return errors.As(err, &partial)
+}
+
+// UntrustedError is returned by repositories which verify their metadata, i.e. TUF, if the verification fails
+type UntrustedError struct {
+	Err error
+}
+
+func (e *UntrustedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UntrustedError) Unwrap() error {
+	return e.Err
+}
+
+// IsUntrusted returns true if err was caused by metadata which failed verification. Such errors must never be
+// hidden, i.e. by falling back to cached metadata.
+func IsUntrusted(err error) bool {
+	var untrusted *UntrustedError
+	return errors.As(err, &untrusted) || errors.Is(err, ErrInvalidSignature) || errors.Is(err, ErrMissingSignature)
+}
+
 type NewRepository func(*viper.Viper) (Repository, error)
+
+var (
+	registryLock = &sync.Mutex{}
+	registry     = make(map[string]NewRepository)
+)
+
+// RegisterBuilder makes a repository type available under name, so it can be selected via repo.type
+func RegisterBuilder(name string, b NewRepository) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[name] = b
+}
+
+// Builder returns the constructor of the repository type registered under name
+func Builder(name string) (b NewRepository, exists bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	b, exists = registry[name]
+	return
+}
+
+// Types returns the names of all registered repository types
+func Types() (names []string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// VersionFromTag converts a release tag like v1.2.3 into a semver version
+func VersionFromTag(tagName string) (*semver.Version, error) {
+	return semver.NewVersion(strings.TrimPrefix(tagName, "v"))
+}
+
+// versionPlaceholder marks where the version is located within a tag pattern
+const versionPlaceholder = "{version}"
+
+// ErrTagMismatch is returned if a tag doesn't match the configured tag pattern
+var ErrTagMismatch = errors.New("tag doesn't match pattern")
+
+// TagPattern extracts versions from tags which contain more than just the version, i.e. firmware-v{version}
+// or board-x/{version}. This allows to keep firmware releases in a repository together with unrelated releases.
+type TagPattern struct {
+	pattern string
+	regex   *regexp.Regexp
+}
+
+// NewTagPattern parses a tag pattern, which needs to contain the placeholder {version} exactly once. All other
+// characters are matched literally.
+func NewTagPattern(pattern string) (*TagPattern, error) {
+	if strings.Count(pattern, versionPlaceholder) != 1 {
+		return nil, fmt.Errorf("tag pattern %s needs to contain %s exactly once", pattern, versionPlaceholder)
+	}
+	prefix, suffix, _ := strings.Cut(pattern, versionPlaceholder)
+	regex, err := regexp.Compile("^" + regexp.QuoteMeta(prefix) + "(.+)" + regexp.QuoteMeta(suffix) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag pattern %s: %w", pattern, err)
+	}
+	return &TagPattern{pattern: pattern, regex: regex}, nil
+}
+
+func (p *TagPattern) String() string {
+	return p.pattern
+}
+
+// Version extracts the version from tagName. ErrTagMismatch is returned if the tag doesn't match the pattern
+// at all, so callers can tell unrelated tags apart from tags with an invalid version.
+func (p *TagPattern) Version(tagName string) (*semver.Version, error) {
+	submatches := p.regex.FindStringSubmatch(tagName)
+	if len(submatches) < 2 {
+		return nil, ErrTagMismatch
+	}
+	return semver.NewVersion(submatches[1])
+}
+
+var versionFromBundleNameRegex = regexp.MustCompile(`_v?([0-9]+\.[0-9]+\.[0-9]+[0-9A-Za-z\-\.\+]*)_update\.bin$`)
+
+// VersionFromBundleName extracts the version from bundle names like cbpifw-rpi3_v1.2.3_update.bin
+// and returns an empty string if the name doesn't contain a version
+func VersionFromBundleName(name string) string {
+	submatches := versionFromBundleNameRegex.FindStringSubmatch(name)
+	if len(submatches) > 1 {
+		return submatches[1]
+	}
+	return ""
+}
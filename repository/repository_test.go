@@ -1 +1,187 @@
 package repository
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagPattern(t *testing.T) {
+	_, err := NewTagPattern("firmware")
+	assert.Error(t, err)
+
+	pattern, err := NewTagPattern("board-x/firmware-v{version}")
+	require.NoError(t, err)
+
+	version, err := pattern.Version("board-x/firmware-v1.2.3-rc.1")
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3-rc.1", version.String())
+
+	_, err = pattern.Version("app-v1.2.3")
+	assert.ErrorIs(t, err, ErrTagMismatch)
+	_, err = pattern.Version("board-y/firmware-v1.2.3")
+	assert.ErrorIs(t, err, ErrTagMismatch)
+
+	_, err = pattern.Version("board-x/firmware-vnext")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrTagMismatch)
+}
+
+func TestParseReleaseNotes(t *testing.T) {
+	meta, notes, err := ParseReleaseNotes("---\r\nminimumVersion: v1.6.0\r\ncritical: true\r\n---\r\n## Changes\r\n* Fixed sensor")
+	require.NoError(t, err)
+	require.NotNil(t, meta)
+	assert.Equal(t, "v1.6.0", meta.MinimumVersion)
+	assert.True(t, meta.Critical)
+	assert.Equal(t, "## Changes\n* Fixed sensor", notes)
+
+	body := "## Changes\n* Fixed sensor\n\n```rauc-meta\nrolloutPercentage: 20\nsummary: Sensor fix\n```\n"
+	meta, notes, err = ParseReleaseNotes(body)
+	require.NoError(t, err)
+	require.NotNil(t, meta)
+	assert.Equal(t, 20, *meta.RolloutPercentage)
+	assert.Equal(t, "Sensor fix", meta.Summary)
+	assert.Equal(t, "## Changes\n* Fixed sensor", notes)
+
+	meta, notes, err = ParseReleaseNotes("Just notes\n---\nwith a rule")
+	require.NoError(t, err)
+	assert.Nil(t, meta)
+	assert.Equal(t, "Just notes\n---\nwith a rule", notes)
+}
+
+func TestSetReleaseNotes(t *testing.T) {
+	update := &Update{}
+	require.NoError(t, update.SetReleaseNotes("```rauc-meta\nminimumVersion: 1.6.0\nrolloutPercentage: 50\n```\nNotes"))
+	assert.Equal(t, "Notes", update.Notes)
+	assert.Equal(t, "1.6.0", update.MinimumVersion.String())
+	assert.Equal(t, 50, *update.RolloutPercentage)
+
+	update = &Update{}
+	body := "```rauc-meta\nrolloutPercentage: 150\n```\nNotes"
+	assert.Error(t, update.SetReleaseNotes(body))
+	assert.Equal(t, body, update.Notes)
+	assert.Nil(t, update.RolloutPercentage)
+}
+
+func TestParseChecksums(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	checksums := ParseChecksums([]byte(hash+"  cbpifw-rpi3_v1.8.2_update.bin\n"+
+		strings.ToUpper(hash)+" *./cbpifw-rpi4_v1.8.2_update.bin\n"+
+		"SHA256 (cbpifw-rpi5_v1.8.2_update.bin) = "+hash+"\n"+
+		"this is not a checksum\n"), "SHA256SUMS")
+	assert.Equal(t, map[string]string{
+		"cbpifw-rpi3_v1.8.2_update.bin": hash,
+		"cbpifw-rpi4_v1.8.2_update.bin": hash,
+		"cbpifw-rpi5_v1.8.2_update.bin": hash,
+	}, checksums)
+
+	checksums = ParseChecksums([]byte(hash+"\n"), "cbpifw-rpi3_v1.8.2_update.bin.sha256")
+	assert.Equal(t, map[string]string{"cbpifw-rpi3_v1.8.2_update.bin": hash}, checksums)
+}
+
+func TestRegistry(t *testing.T) {
+	// Start with an empty registry, so the test neither depends on nor leaks registrations of other runs
+	registryLock.Lock()
+	registered := registry
+	registry = make(map[string]NewRepository)
+	registryLock.Unlock()
+	t.Cleanup(func() {
+		registryLock.Lock()
+		registry = registered
+		registryLock.Unlock()
+	})
+
+	_, exists := Builder("test")
+	assert.False(t, exists)
+
+	RegisterBuilder("test", func(*viper.Viper) (Repository, error) {
+		return nil, nil
+	})
+	b, exists := Builder("test")
+	require.True(t, exists)
+	assert.NotNil(t, b)
+	assert.Contains(t, Types(), "test")
+}
+
+func TestChannelOf(t *testing.T) {
+	for version, channel := range map[string]string{
+		"1.9.0":                  StableChannel,
+		"1.9.0-beta.2":           "beta",
+		"1.9.0-rc1":              "rc",
+		"1.9.0-nightly.20230120": "nightly",
+		"1.9.0-Internal-3":       "internal",
+		"1.9.0-20230120":         PrereleaseChannel,
+	} {
+		v := semver.New(version)
+		assert.Equal(t, channel, ChannelOf(&Update{Version: v, Prerelease: v.PreRelease != ""}), version)
+	}
+
+	update := &Update{Version: semver.New("1.9.0-rc1")}
+	require.NoError(t, update.SetReleaseNotes("```rauc-meta\nchannel: Nightly\n```\nNotes"))
+	assert.Equal(t, "nightly", ChannelOf(update))
+}
+
+func TestYankedReleaseNotes(t *testing.T) {
+	update := &Update{Version: semver.New("1.8.1")}
+	require.NoError(t, update.SetReleaseNotes("---\nyankReason: Breaks the temperature sensor\n---\nNotes"))
+	assert.True(t, update.Yanked)
+	assert.Equal(t, "Breaks the temperature sensor", update.YankReason)
+}
+
+func TestRolloutPercentageAt(t *testing.T) {
+	released := time.Date(2023, 1, 20, 10, 0, 0, 0, time.UTC)
+	update := &Update{ReleaseDate: released}
+	assert.Equal(t, 100, RolloutPercentageAt(update, released))
+
+	percentage := 20
+	update.RolloutPercentage = &percentage
+	assert.Equal(t, 20, RolloutPercentageAt(update, released))
+
+	require.NoError(t, update.SetReleaseNotes("```rauc-meta\nrolloutSchedule:\n  - after: 1h\n    percentage: 5\n  - after: 48h\n    percentage: 50\n```\n"))
+	assert.Equal(t, 0, RolloutPercentageAt(update, released))
+	assert.Equal(t, 5, RolloutPercentageAt(update, released.Add(time.Hour)))
+	assert.Equal(t, 50, RolloutPercentageAt(update, released.Add(72*time.Hour)))
+
+	assert.Error(t, update.SetReleaseNotes("```rauc-meta\nrolloutSchedule:\n  - after: 1h\n    percentage: 500\n```\n"))
+}
+
+type rejectingRepo struct {
+	rejected []string
+}
+
+func (r *rejectingRepo) Updates(ctx context.Context) ([]Update, error) {
+	return nil, nil
+}
+
+func (r *rejectingRepo) UpdateRejected(ctx context.Context, update *Update, reason error) error {
+	r.rejected = append(r.rejected, update.Version.String())
+	return nil
+}
+
+func TestWrapper(t *testing.T) {
+	inner := &rejectingRepo{}
+	wrapper := Wrap(inner)
+	update := &Update{Version: semver.New("1.8.2")}
+	require.NoError(t, wrapper.UpdateRejected(context.Background(), update, ErrAlreadyInstalled))
+	assert.Equal(t, []string{"1.8.2"}, inner.rejected)
+	// Optional interfaces the wrapped repository doesn't implement are ignored
+	require.NoError(t, wrapper.InstallStarted(context.Background(), update))
+	assert.Nil(t, wrapper.RepositoryStatus())
+
+	routed := WrapRouted(func(update *Update) Repository {
+		if update != nil && update.Version.Major == 2 {
+			return inner
+		}
+		return nil
+	})
+	require.NoError(t, routed.UpdateRejected(context.Background(), update, ErrAlreadyInstalled))
+	require.NoError(t, routed.UpdateRejected(context.Background(), &Update{Version: semver.New("2.0.0")}, ErrAlreadyInstalled))
+	assert.Equal(t, []string{"1.8.2", "2.0.0"}, inner.rejected)
+	require.NoError(t, routed.Watch(context.Background(), func() {}))
+}
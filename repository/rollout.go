@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// RolloutStage raises the share of devices receiving an update once the given time has passed since the
+// release date
+type RolloutStage struct {
+	After      time.Duration `yaml:"after"`
+	Percentage int           `yaml:"percentage"`
+}
+
+func (s RolloutStage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		After      string `json:"after"`
+		Percentage int    `json:"percentage"`
+	}{After: s.After.String(), Percentage: s.Percentage})
+}
+
+func (s *RolloutStage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		After      string `json:"after"`
+		Percentage int    `json:"percentage"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	after, err := time.ParseDuration(raw.After)
+	if err != nil {
+		return fmt.Errorf("invalid rollout stage %q: %w", raw.After, err)
+	}
+	s.After, s.Percentage = after, raw.Percentage
+	return nil
+}
+
+// ValidateRollout checks that all percentages of a rollout are between 0 and 100
+func ValidateRollout(percentage *int, schedule []RolloutStage) error {
+	if percentage != nil && (*percentage < 0 || *percentage > 100) {
+		return fmt.Errorf("rollout percentage %d is not between 0 and 100", *percentage)
+	}
+	for _, stage := range schedule {
+		if stage.Percentage < 0 || stage.Percentage > 100 {
+			return fmt.Errorf("rollout percentage %d is not between 0 and 100", stage.Percentage)
+		}
+	}
+	return nil
+}
+
+// RolloutPercentageAt returns the share of devices which should receive the update at the given time. A
+// rollout schedule takes precedence over a fixed percentage, before the first stage of the schedule no device
+// receives the update. Updates without either are meant for all devices.
+func RolloutPercentageAt(update *Update, now time.Time) int {
+	if len(update.RolloutSchedule) > 0 {
+		percentage := 0
+		for _, stage := range update.RolloutSchedule {
+			if !now.Before(update.ReleaseDate.Add(stage.After)) && stage.Percentage > percentage {
+				percentage = stage.Percentage
+			}
+		}
+		return percentage
+	}
+	if update.RolloutPercentage != nil {
+		return *update.RolloutPercentage
+	}
+	return 100
+}
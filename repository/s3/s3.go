@@ -0,0 +1,264 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultRegion        = "us-east-1"
+	defaultPresignExpiry = 24 * time.Hour
+	// presigned URLs can't be valid for longer than seven days
+	maxPresignExpiry = 7 * 24 * time.Hour
+
+	metaVersion    = "X-Amz-Meta-Version"
+	metaName       = "X-Amz-Meta-Name"
+	metaCompatible = "X-Amz-Meta-Compatible"
+	metaPrerelease = "X-Amz-Meta-Prerelease"
+)
+
+type listBucketResult struct {
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+	Contents              []object `xml:"Contents"`
+}
+
+type object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+type Config struct {
+	// Endpoint of the S3 API, defaults to AWS in the configured region
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint, which MinIO and Ceph RGW usually need
+	PathStyle bool
+	// UseMetadata reads version, name, compatible and prerelease from the object metadata (x-amz-meta-*).
+	// This needs an additional HEAD request per bundle.
+	UseMetadata   bool
+	PresignExpiry time.Duration
+}
+
+// S3Repo lists update bundles in an S3 compatible bucket and hands out presigned URLs, so rauc can
+// download them without any credentials
+type S3Repo struct {
+	client   *http.Client
+	endpoint *url.URL
+	conf     Config
+	signer   *signer
+	logger   logrus.FieldLogger
+	now      func() time.Time
+}
+
+func init() {
+	repository.RegisterBuilder("s3", New)
+}
+
+func New(conf *viper.Viper) (repository.Repository, error) {
+	conf.SetDefault("region", defaultRegion)
+	conf.SetDefault("pathStyle", conf.IsSet("endpoint"))
+	conf.SetDefault("presignExpiry", defaultPresignExpiry)
+	c := Config{
+		Endpoint:        conf.GetString("endpoint"),
+		Region:          conf.GetString("region"),
+		Bucket:          conf.GetString("bucket"),
+		Prefix:          conf.GetString("prefix"),
+		AccessKeyID:     conf.GetString("accessKeyID"),
+		SecretAccessKey: conf.GetString("secretAccessKey"),
+		PathStyle:       conf.GetBool("pathStyle"),
+		UseMetadata:     conf.GetBool("useMetadata"),
+		PresignExpiry:   conf.GetDuration("presignExpiry"),
+	}
+	if c.AccessKeyID == "" && c.SecretAccessKey == "" {
+		c.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return NewRepo(c)
+}
+
+func NewRepo(conf Config) (*S3Repo, error) {
+	if conf.Bucket == "" {
+		return nil, errors.New("no S3 bucket specified")
+	}
+	if conf.Region == "" {
+		conf.Region = defaultRegion
+	}
+	if conf.Endpoint == "" {
+		conf.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", conf.Region)
+	}
+	if conf.PresignExpiry <= 0 {
+		conf.PresignExpiry = defaultPresignExpiry
+	}
+	if conf.PresignExpiry > maxPresignExpiry {
+		conf.PresignExpiry = maxPresignExpiry
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(conf.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %w", conf.Endpoint, err)
+	}
+	return &S3Repo{
+		client:   http.DefaultClient,
+		endpoint: endpoint,
+		conf:     conf,
+		signer: &signer{
+			accessKeyID:     conf.AccessKeyID,
+			secretAccessKey: conf.SecretAccessKey,
+			region:          conf.Region,
+		},
+		logger: logrus.WithFields(logrus.Fields{"repotype": "s3", "endpoint": conf.Endpoint,
+			"bucket": conf.Bucket, "prefix": conf.Prefix}),
+		now: time.Now,
+	}, nil
+}
+
+// bucketURL returns the base URL of the bucket depending on the addressing style
+func (s *S3Repo) bucketURL() *url.URL {
+	u := *s.endpoint
+	if s.conf.PathStyle {
+		u.Path = u.Path + "/" + s.conf.Bucket
+	} else {
+		u.Host = s.conf.Bucket + "." + u.Host
+	}
+	return &u
+}
+
+func (s *S3Repo) objectURL(key string) *url.URL {
+	u := s.bucketURL()
+	u.Path = u.Path + "/" + key
+	return u
+}
+
+func (s *S3Repo) do(ctx context.Context, method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.signer.sign(req, s.now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *S3Repo) listObjects(ctx context.Context) (objects []object, err error) {
+	continuationToken := ""
+	for {
+		u := s.bucketURL()
+		u.Path = u.Path + "/"
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if s.conf.Prefix != "" {
+			query.Set("prefix", s.conf.Prefix)
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		u.RawQuery = canonicalQuery(query)
+
+		resp, err := s.do(ctx, http.MethodGet, u)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bucket listing: %w", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *S3Repo) Updates(ctx context.Context) (updates []repository.Update, err error) {
+	logger := s.logger
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list S3 bucket %s: %w", s.conf.Bucket, err)
+	}
+
+	updatesByVersion := make(map[string]*repository.Update)
+	for _, obj := range objects {
+		_, assetName := path.Split(obj.Key)
+		if !strings.HasSuffix(assetName, "_update.bin") {
+			continue
+		}
+		logger := logger.WithField("key", obj.Key)
+		versionString := repository.VersionFromBundleName(assetName)
+		name, compatible := "", ""
+		prerelease := false
+		if s.conf.UseMetadata {
+			resp, err := s.do(ctx, http.MethodHead, s.objectURL(obj.Key))
+			if err != nil {
+				logger.WithError(err).Error("failed to read object metadata")
+				continue
+			}
+			resp.Body.Close()
+			if v := resp.Header.Get(metaVersion); v != "" {
+				versionString = v
+			}
+			name = resp.Header.Get(metaName)
+			compatible = resp.Header.Get(metaCompatible)
+			prerelease, _ = strconv.ParseBool(resp.Header.Get(metaPrerelease))
+		}
+		version, err := semver.NewVersion(versionString)
+		if err != nil {
+			logger.WithError(err).Error("bundle can't be used because it has no semver version")
+			continue
+		}
+
+		update, exists := updatesByVersion[version.String()]
+		if !exists {
+			update = &repository.Update{
+				Version:     version,
+				ReleaseDate: obj.LastModified,
+				Name:        name,
+				Prerelease:  prerelease || version.PreRelease != "",
+			}
+			updatesByVersion[version.String()] = update
+		}
+		update.Bundles = append(update.Bundles, &repository.BundleLink{
+			URL:           s.signer.presign(s.objectURL(obj.Key), s.now(), s.conf.PresignExpiry),
+			AssetName:     assetName,
+			Compatibility: compatible,
+			Size:          obj.Size,
+		})
+	}
+
+	for _, update := range updatesByVersion {
+		updates = append(updates, *update)
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Version.LessThan(*updates[j].Version)
+	})
+	return updates, nil
+}
@@ -0,0 +1,226 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultNamespace is the namespace ssh-keygen -Y sign uses by convention for files
+const DefaultNamespace = "file"
+
+const (
+	minisignAlgorithm          = "Ed"
+	minisignPrehashedAlgorithm = "ED"
+	minisignKeyIDSize          = 8
+	trustedCommentPrefix       = "trusted comment: "
+
+	sshSigMagic       = "SSHSIG"
+	sshSigVersion     = 1
+	sshSigPEMType     = "SSH SIGNATURE"
+	sshSigArmorPrefix = "-----BEGIN " + sshSigPEMType
+)
+
+type minisignKey struct {
+	keyID  []byte
+	public ed25519.PublicKey
+}
+
+// Verifier verifies detached minisign and SSH signatures against a set of trusted public keys
+type Verifier struct {
+	minisignKeys []minisignKey
+	sshKeys      []ssh.PublicKey
+	namespace    string
+}
+
+// NewVerifier creates a verifier which trusts the given keys. Keys are either minisign public keys, with or
+// without the untrusted comment line, or SSH public keys in the authorized_keys format. SSH signatures need to
+// be created for namespace.
+func NewVerifier(keys []string, namespace string) (*Verifier, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys for signature verification configured")
+	}
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	v := &Verifier{namespace: namespace}
+	for _, k := range keys {
+		if err := v.addKey(strings.TrimSpace(k)); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// LoadVerifier creates a verifier from keys given directly and keys stored in files
+func LoadVerifier(keys, keyFiles []string, namespace string) (*Verifier, error) {
+	for _, keyFile := range keyFiles {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key from %s: %w", keyFile, err)
+		}
+		keys = append(keys, string(data))
+	}
+	return NewVerifier(keys, namespace)
+}
+
+func (v *Verifier) addKey(k string) error {
+	if strings.HasPrefix(k, "untrusted comment:") {
+		lines := strings.SplitN(k, "\n", 2)
+		if len(lines) < 2 {
+			return errors.New("minisign public key is missing")
+		}
+		k = strings.TrimSpace(lines[1])
+	}
+	if data, err := base64.StdEncoding.DecodeString(k); err == nil && len(data) == 2+minisignKeyIDSize+ed25519.PublicKeySize {
+		if string(data[:2]) != minisignAlgorithm {
+			return fmt.Errorf("unsupported minisign key algorithm %q", data[:2])
+		}
+		v.minisignKeys = append(v.minisignKeys, minisignKey{
+			keyID:  data[2 : 2+minisignKeyIDSize],
+			public: ed25519.PublicKey(data[2+minisignKeyIDSize:]),
+		})
+		return nil
+	}
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+	if err != nil {
+		return fmt.Errorf("public key is neither a minisign nor a SSH key: %w", err)
+	}
+	v.sshKeys = append(v.sshKeys, sshKey)
+	return nil
+}
+
+// Verify checks that sig is a valid signature over message made by one of the trusted keys. The format of
+// the signature is detected automatically.
+func (v *Verifier) Verify(message, sig []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte(sshSigArmorPrefix)) {
+		return v.verifySSH(message, sig)
+	}
+	return v.verifyMinisign(message, sig)
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", repository.ErrInvalidSignature, fmt.Sprintf(format, args...))
+}
+
+// verifyMinisign verifies signatures in the format described at https://jedisct1.github.io/minisign/
+func (v *Verifier) verifyMinisign(message, sig []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) < 4 {
+		return invalid("malformed minisign signature")
+	}
+	sigData, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sigData) != 2+minisignKeyIDSize+ed25519.SignatureSize {
+		return invalid("malformed minisign signature")
+	}
+	trustedComment := strings.TrimRight(lines[2], "\r")
+	if !strings.HasPrefix(trustedComment, trustedCommentPrefix) {
+		return invalid("minisign signature has no trusted comment")
+	}
+	trustedComment = strings.TrimPrefix(trustedComment, trustedCommentPrefix)
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return invalid("malformed minisign global signature")
+	}
+
+	algorithm, keyID, signature := string(sigData[:2]), sigData[2:2+minisignKeyIDSize], sigData[2+minisignKeyIDSize:]
+	switch algorithm {
+	case minisignAlgorithm:
+	case minisignPrehashedAlgorithm:
+		hash := blake2b.Sum512(message)
+		message = hash[:]
+	default:
+		return invalid("unsupported minisign algorithm %q", algorithm)
+	}
+
+	for _, k := range v.minisignKeys {
+		if !bytes.Equal(k.keyID, keyID) {
+			continue
+		}
+		if !ed25519.Verify(k.public, message, signature) {
+			return invalid("minisign signature doesn't match")
+		}
+		if !ed25519.Verify(k.public, append(append([]byte{}, signature...), trustedComment...), globalSig) {
+			return invalid("minisign trusted comment has been tampered with")
+		}
+		return nil
+	}
+	return invalid("minisign signature was made by an untrusted key %X", keyID)
+}
+
+type sshSignature struct {
+	PublicKey     []byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// verifySSH verifies signatures created with ssh-keygen -Y sign, as described in PROTOCOL.sshsig of OpenSSH
+func (v *Verifier) verifySSH(message, sig []byte) error {
+	block, _ := pem.Decode(bytes.TrimSpace(sig))
+	if block == nil || block.Type != sshSigPEMType {
+		return invalid("malformed SSH signature")
+	}
+	data := block.Bytes
+	if !bytes.HasPrefix(data, []byte(sshSigMagic)) || len(data) < len(sshSigMagic)+4 {
+		return invalid("malformed SSH signature")
+	}
+	data = data[len(sshSigMagic):]
+	if version := binary.BigEndian.Uint32(data); version != sshSigVersion {
+		return invalid("unsupported SSH signature version %d", version)
+	}
+	var parsed sshSignature
+	if err := ssh.Unmarshal(data[4:], &parsed); err != nil {
+		return invalid("malformed SSH signature: %s", err)
+	}
+	if parsed.Namespace != v.namespace {
+		return invalid("SSH signature has namespace %q instead of %q", parsed.Namespace, v.namespace)
+	}
+
+	var hash []byte
+	switch parsed.HashAlgorithm {
+	case "sha256":
+		sum := sha256.Sum256(message)
+		hash = sum[:]
+	case "sha512":
+		sum := sha512.Sum512(message)
+		hash = sum[:]
+	default:
+		return invalid("unsupported SSH signature hash algorithm %q", parsed.HashAlgorithm)
+	}
+
+	signature := &ssh.Signature{}
+	if err := ssh.Unmarshal(parsed.Signature, signature); err != nil {
+		return invalid("malformed SSH signature: %s", err)
+	}
+	signedData := append([]byte(sshSigMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Hash          []byte
+	}{parsed.Namespace, parsed.Reserved, parsed.HashAlgorithm, hash})...)
+
+	for _, k := range v.sshKeys {
+		if !bytes.Equal(k.Marshal(), parsed.PublicKey) {
+			continue
+		}
+		if err := k.Verify(signedData, signature); err != nil {
+			return invalid("SSH signature doesn't match: %s", err)
+		}
+		return nil
+	}
+	return invalid("SSH signature was made by an untrusted key")
+}
@@ -0,0 +1,103 @@
+package signature
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+const checksums = "abababababababababababababababababababababababababababababababab  cbpifw-raspberrypi3-64_v1.8.2_update.bin\n"
+
+// Created with ssh-keygen -Y sign -f key -n file SHA256SUMS
+const (
+	sshPublicKeyVector = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMPmkSvm+paemLHDEfL6B+JDBgXdo68nG9jsn+iCRghI release@example.com"
+	sshSignatureVector = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgw+aRK+b6lp6YscMR8voH4kMGBd
+2jrycb2Oyf6IJGCEgAAAAEZmlsZQAAAAAAAAAGc2hhNTEyAAAAUwAAAAtzc2gtZWQyNTUx
+OQAAAEA9ZAvBmrosp+WuefjNkHJtxSXHUGtbnw8ySAqezNa+Nf0hMbT1Z5KZ4Zbk3qw0wK
+DQLmg9OSzs45Yn+KgxCbgK
+-----END SSH SIGNATURE-----
+`
+)
+
+func TestVerifySSHSignature(t *testing.T) {
+	v, err := NewVerifier([]string{sshPublicKeyVector}, "")
+	require.NoError(t, err)
+	assert.NoError(t, v.Verify([]byte(checksums), []byte(sshSignatureVector)))
+
+	err = v.Verify([]byte(checksums+"tampered"), []byte(sshSignatureVector))
+	assert.ErrorIs(t, err, repository.ErrInvalidSignature)
+
+	v, err = NewVerifier([]string{sshPublicKeyVector}, "other-namespace")
+	require.NoError(t, err)
+	assert.ErrorIs(t, v.Verify([]byte(checksums), []byte(sshSignatureVector)), repository.ErrInvalidSignature)
+}
+
+type minisignKeyPair struct {
+	publicKey string
+	private   ed25519.PrivateKey
+	keyID     []byte
+}
+
+func newMinisignKey(t *testing.T) *minisignKeyPair {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyID := make([]byte, minisignKeyIDSize)
+	_, err = rand.Read(keyID)
+	require.NoError(t, err)
+	data := append(append([]byte(minisignAlgorithm), keyID...), public...)
+	return &minisignKeyPair{
+		publicKey: "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(data) + "\n",
+		private:   private,
+		keyID:     keyID,
+	}
+}
+
+func (k *minisignKeyPair) sign(message []byte, algorithm, trustedComment string) string {
+	if algorithm == minisignPrehashedAlgorithm {
+		hash := blake2b.Sum512(message)
+		message = hash[:]
+	}
+	sig := ed25519.Sign(k.private, message)
+	globalSig := ed25519.Sign(k.private, append(append([]byte{}, sig...), trustedComment...))
+	return fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), k.keyID...), sig...)),
+		trustedComment,
+		base64.StdEncoding.EncodeToString(globalSig))
+}
+
+func TestVerifyMinisignSignature(t *testing.T) {
+	key := newMinisignKey(t)
+	v, err := NewVerifier([]string{sshPublicKeyVector, key.publicKey}, "")
+	require.NoError(t, err)
+
+	for _, algorithm := range []string{minisignAlgorithm, minisignPrehashedAlgorithm} {
+		sig := key.sign([]byte(checksums), algorithm, "timestamp:1674208800\tfile:SHA256SUMS")
+		assert.NoError(t, v.Verify([]byte(checksums), []byte(sig)), algorithm)
+		assert.ErrorIs(t, v.Verify([]byte(checksums+"tampered"), []byte(sig)), repository.ErrInvalidSignature, algorithm)
+	}
+
+	// The trusted comment is covered by the global signature
+	sig := key.sign([]byte(checksums), minisignPrehashedAlgorithm, "timestamp:1674208800")
+	tampered := strings.Replace(sig, "timestamp:1674208800", "timestamp:1999999999", 1)
+	assert.ErrorIs(t, v.Verify([]byte(checksums), []byte(tampered)), repository.ErrInvalidSignature)
+
+	other := newMinisignKey(t)
+	sig = other.sign([]byte(checksums), minisignPrehashedAlgorithm, "")
+	assert.ErrorIs(t, v.Verify([]byte(checksums), []byte(sig)), repository.ErrInvalidSignature)
+}
+
+func TestInvalidKeys(t *testing.T) {
+	_, err := NewVerifier(nil, "")
+	assert.Error(t, err)
+	_, err = NewVerifier([]string{"not a key"}, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,248 @@
+package tuf
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+)
+
+const (
+	roleRoot      = "root"
+	roleTimestamp = "timestamp"
+	roleSnapshot  = "snapshot"
+	roleTargets   = "targets"
+
+	keyTypeEd25519 = "ed25519"
+)
+
+var (
+	ErrExpired           = errors.New("metadata expired")
+	ErrRollback          = errors.New("metadata version is older than the trusted version")
+	ErrThreshold         = errors.New("not enough valid signatures")
+	ErrVersionMismatch   = errors.New("metadata version doesn't match the version listed by the parent role")
+	ErrUnexpectedType    = errors.New("unexpected metadata type")
+	ErrUnsupportedKey    = errors.New("unsupported key type")
+	ErrHashMismatch      = errors.New("metadata hash doesn't match")
+	ErrUnknownTargetFile = errors.New("bundle is not listed in the targets metadata")
+	ErrTargetMismatch    = errors.New("release doesn't match the release signed with its target")
+)
+
+// envelope is a signed metadata file as it is stored on the server
+type envelope struct {
+	Signatures []signature     `json:"signatures"`
+	Signed     json.RawMessage `json:"signed"`
+}
+
+type signature struct {
+	KeyID     string `json:"keyid"`
+	Signature string `json:"sig"`
+}
+
+type key struct {
+	KeyType string `json:"keytype"`
+	Scheme  string `json:"scheme"`
+	KeyVal  struct {
+		Public string `json:"public"`
+	} `json:"keyval"`
+}
+
+type role struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+type common struct {
+	Type        string    `json:"_type"`
+	SpecVersion string    `json:"spec_version"`
+	Version     int64     `json:"version"`
+	Expires     time.Time `json:"expires"`
+}
+
+type rootMetadata struct {
+	common
+	ConsistentSnapshot bool            `json:"consistent_snapshot"`
+	Keys               map[string]key  `json:"keys"`
+	Roles              map[string]role `json:"roles"`
+}
+
+type metaFile struct {
+	Version int64             `json:"version"`
+	Length  int64             `json:"length,omitempty"`
+	Hashes  map[string]string `json:"hashes,omitempty"`
+}
+
+// timestampMetadata and snapshotMetadata share the same structure, the timestamp lists the snapshot and the
+// snapshot lists all targets metadata
+type timestampMetadata struct {
+	common
+	Meta map[string]metaFile `json:"meta"`
+}
+
+type snapshotMetadata struct {
+	common
+	Meta map[string]metaFile `json:"meta"`
+}
+
+type targetFile struct {
+	Length int64             `json:"length"`
+	Hashes map[string]string `json:"hashes"`
+	Custom *targetCustom     `json:"custom,omitempty"`
+}
+
+// targetCustom is the release metadata signed together with a bundle, so the release source can't publish an
+// old bundle under a newer version or change the flags of a release
+type targetCustom struct {
+	Version           string                    `json:"version"`
+	Channel           string                    `json:"channel,omitempty"`
+	MinimumVersion    string                    `json:"minimumVersion,omitempty"`
+	Mandatory         bool                      `json:"mandatory,omitempty"`
+	Yanked            bool                      `json:"yanked,omitempty"`
+	YankReason        string                    `json:"yankReason,omitempty"`
+	Critical          bool                      `json:"critical,omitempty"`
+	RolloutPercentage *int                      `json:"rolloutPercentage,omitempty"`
+	RolloutSchedule   []repository.RolloutStage `json:"rolloutSchedule,omitempty"`
+}
+
+type targetsMetadata struct {
+	common
+	Targets map[string]targetFile `json:"targets"`
+}
+
+// apply replaces the release metadata of the update with the signed one. Releases which have been published
+// under another version than the signed one are refused. Releases can still be yanked by the release source,
+// as withdrawing a release is never harmful.
+func (c *targetCustom) apply(update *repository.Update) error {
+	if c == nil || c.Version == "" {
+		return fmt.Errorf("%w: no version is signed with the target", ErrTargetMismatch)
+	}
+	version, err := repository.VersionFromTag(c.Version)
+	if err != nil {
+		return fmt.Errorf("invalid signed version %s: %w", c.Version, err)
+	}
+	if !version.Equal(*update.Version) {
+		return fmt.Errorf("%w: release %s contains the target of version %s", ErrTargetMismatch, update.Version, version)
+	}
+	update.MinimumVersion = nil
+	if c.MinimumVersion != "" {
+		if update.MinimumVersion, err = repository.VersionFromTag(c.MinimumVersion); err != nil {
+			return fmt.Errorf("invalid signed minimum version %s: %w", c.MinimumVersion, err)
+		}
+	}
+	if err := repository.ValidateRollout(c.RolloutPercentage, c.RolloutSchedule); err != nil {
+		return err
+	}
+	update.Prerelease = version.PreRelease != ""
+	update.Channel = c.Channel
+	update.Mandatory = c.Mandatory
+	update.Critical = c.Critical
+	if c.Yanked {
+		update.Yanked, update.YankReason = true, c.YankReason
+	}
+	update.RolloutPercentage = c.RolloutPercentage
+	update.RolloutSchedule = c.RolloutSchedule
+	return nil
+}
+
+// parse decodes the signed part of a metadata file and checks its type
+func parse(data []byte, roleName string, signed interface{}) (*envelope, error) {
+	env := &envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, fmt.Errorf("failed to decode %s metadata: %w", roleName, err)
+	}
+	var c common
+	if err := json.Unmarshal(env.Signed, &c); err != nil {
+		return nil, fmt.Errorf("failed to decode %s metadata: %w", roleName, err)
+	}
+	if c.Type != roleName {
+		return nil, fmt.Errorf("%w: expected %s, got %s", ErrUnexpectedType, roleName, c.Type)
+	}
+	if err := json.Unmarshal(env.Signed, signed); err != nil {
+		return nil, fmt.Errorf("failed to decode %s metadata: %w", roleName, err)
+	}
+	return env, nil
+}
+
+// verify checks that the metadata is signed by at least threshold keys of the role as defined by root
+func (r *rootMetadata) verify(env *envelope, roleName string) error {
+	role, exists := r.Roles[roleName]
+	if !exists {
+		return fmt.Errorf("root metadata doesn't define role %s", roleName)
+	}
+	if role.Threshold < 1 {
+		return fmt.Errorf("invalid threshold %d for role %s", role.Threshold, roleName)
+	}
+	payload, err := canonicalJSON(env.Signed)
+	if err != nil {
+		return fmt.Errorf("failed to canonicalize %s metadata: %w", roleName, err)
+	}
+
+	authorized := make(map[string]bool)
+	for _, keyID := range role.KeyIDs {
+		authorized[keyID] = true
+	}
+	valid := make(map[string]bool)
+	for _, sig := range env.Signatures {
+		if !authorized[sig.KeyID] || valid[sig.KeyID] {
+			continue
+		}
+		k, exists := r.Keys[sig.KeyID]
+		if !exists {
+			continue
+		}
+		if err := k.verify(payload, sig.Signature); err == nil {
+			valid[sig.KeyID] = true
+		}
+	}
+	if len(valid) < role.Threshold {
+		return fmt.Errorf("%w for role %s: %d of %d", ErrThreshold, roleName, len(valid), role.Threshold)
+	}
+	return nil
+}
+
+// sameKeys reports whether a role is signed by the same keys in both root versions
+func (r *rootMetadata) sameKeys(other *rootMetadata, roleName string) bool {
+	a, b := r.Roles[roleName], other.Roles[roleName]
+	if a.Threshold != b.Threshold || len(a.KeyIDs) != len(b.KeyIDs) {
+		return false
+	}
+	keyIDs := make(map[string]bool)
+	for _, keyID := range a.KeyIDs {
+		keyIDs[keyID] = true
+	}
+	for _, keyID := range b.KeyIDs {
+		if !keyIDs[keyID] || r.Keys[keyID].KeyVal.Public != other.Keys[keyID].KeyVal.Public {
+			return false
+		}
+	}
+	return true
+}
+
+func (k key) verify(payload []byte, sig string) error {
+	if k.KeyType != keyTypeEd25519 {
+		return fmt.Errorf("%w: %s", ErrUnsupportedKey, k.KeyType)
+	}
+	public, err := hex.DecodeString(k.KeyVal.Public)
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return errors.New("invalid ed25519 public key")
+	}
+	sigBytes, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(public), payload, sigBytes) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func (c common) checkExpiry(roleName string, now time.Time) error {
+	if !now.Before(c.Expires) {
+		return fmt.Errorf("%w: %s metadata expired at %s", ErrExpired, roleName, c.Expires)
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package tuf
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTrustedRoot = "/etc/raucgithub/tuf/root.json"
+	DefaultStateDir    = "/var/lib/raucgithub/tuf"
+
+	// maxMetadataSize limits how much is read from the server if the size of a metadata file is unknown
+	maxMetadataSize = 10 * 1024 * 1024
+	// maxRootRotations limits how many new root versions are accepted at once, so a malicious server
+	// can't keep us busy forever
+	maxRootRotations = 32
+
+	timestampFile = "timestamp.json"
+	snapshotFile  = "snapshot.json"
+	targetsFile   = "targets.json"
+)
+
+var errNotFound = errors.New("metadata not found")
+
+type Config struct {
+	// MetadataURL is the base URL of the TUF metadata, i.e. https://updates.example.com/metadata/
+	MetadataURL string
+	// TrustedRoot is the path of the initial root metadata from the local trust store
+	TrustedRoot string
+	// StateDir stores the most recent verified metadata to detect rollback attacks across restarts
+	StateDir string
+}
+
+// TUFRepo verifies the updates of another repository against metadata signed according to The Update Framework.
+// Only bundles listed in the targets metadata are passed on, together with their length and hash. The version,
+// channel and flags of a release are signed as custom data of its targets, i.e.
+// {"version": "1.9.0", "mandatory": true}, releases published under another version are refused. The
+// timestamp, snapshot and targets roles protect against rollback, freeze and mix-and-match attacks, the
+// root role allows to rotate keys. Delegated targets are not supported.
+type TUFRepo struct {
+	repository.Wrapper
+	repo        repository.Repository
+	client      *http.Client
+	metadataURL *url.URL
+	trustedRoot string
+	stateDir    string
+	logger      logrus.FieldLogger
+	now         func() time.Time
+
+	lock      sync.Mutex
+	root      *rootMetadata
+	timestamp *timestampMetadata
+	snapshot  *snapshotMetadata
+	targets   *targetsMetadata
+}
+
+// New wraps repo, so only updates with bundles listed in the verified targets metadata are returned
+func New(repo repository.Repository, conf Config) (*TUFRepo, error) {
+	if conf.MetadataURL == "" {
+		return nil, errors.New("no TUF metadata URL specified")
+	}
+	if conf.TrustedRoot == "" {
+		conf.TrustedRoot = DefaultTrustedRoot
+	}
+	if conf.StateDir == "" {
+		conf.StateDir = DefaultStateDir
+	}
+	metadataURL, err := url.Parse(strings.TrimSuffix(conf.MetadataURL, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUF metadata URL %s: %w", conf.MetadataURL, err)
+	}
+	if err := os.MkdirAll(conf.StateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create TUF state directory %s: %w", conf.StateDir, err)
+	}
+	t := &TUFRepo{
+		Wrapper:     repository.Wrap(repo),
+		repo:        repo,
+		client:      http.DefaultClient,
+		metadataURL: metadataURL,
+		trustedRoot: conf.TrustedRoot,
+		stateDir:    conf.StateDir,
+		logger:      logrus.WithFields(logrus.Fields{"repotype": "tuf", "metadataURL": metadataURL.String()}),
+		now:         time.Now,
+	}
+	if err := t.loadTrusted(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// loadTrusted loads the root from the trust store and the metadata verified previously. Newer root versions
+// in the state directory are only accepted if they are signed by their predecessor.
+func (t *TUFRepo) loadTrusted() error {
+	data, err := os.ReadFile(t.trustedRoot)
+	if err != nil {
+		return fmt.Errorf("failed to read trusted TUF root from %s: %w", t.trustedRoot, err)
+	}
+	root := &rootMetadata{}
+	env, err := parse(data, roleRoot, root)
+	if err != nil {
+		return err
+	}
+	if err := root.verify(env, roleRoot); err != nil {
+		return fmt.Errorf("trusted TUF root %s is not properly signed: %w", t.trustedRoot, err)
+	}
+	t.root = root
+	if _, err := t.updateRoot(func(name string) ([]byte, error) {
+		return t.loadState(name)
+	}); err != nil {
+		t.logger.WithError(err).Warn("ignoring invalid root metadata in state directory")
+	}
+
+	if data, err := t.loadState(timestampFile); err == nil {
+		timestamp := &timestampMetadata{}
+		if t.verifyState(data, roleTimestamp, timestamp) {
+			t.timestamp = timestamp
+		}
+	}
+	if data, err := t.loadState(snapshotFile); err == nil {
+		snapshot := &snapshotMetadata{}
+		if t.verifyState(data, roleSnapshot, snapshot) {
+			t.snapshot = snapshot
+		}
+	}
+	if data, err := t.loadState(targetsFile); err == nil {
+		targets := &targetsMetadata{}
+		if t.verifyState(data, roleTargets, targets) {
+			t.targets = targets
+		}
+	}
+	return nil
+}
+
+func (t *TUFRepo) verifyState(data []byte, roleName string, signed interface{}) bool {
+	env, err := parse(data, roleName, signed)
+	if err == nil {
+		err = t.root.verify(env, roleName)
+	}
+	if err != nil {
+		t.logger.WithError(err).WithField("role", roleName).Warn("ignoring invalid metadata in state directory")
+		return false
+	}
+	return true
+}
+
+func (t *TUFRepo) Updates(ctx context.Context) ([]repository.Update, error) {
+	updates, err := t.repo.Updates(ctx)
+	if err != nil && !repository.IsPartial(err) {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if refreshErr := t.refresh(ctx); refreshErr != nil {
+		return nil, &repository.UntrustedError{Err: fmt.Errorf("failed to verify TUF metadata: %w", refreshErr)}
+	}
+	return t.verifiedUpdates(updates), err
+}
+
+// refresh updates all metadata in the order required by the TUF specification
+func (t *TUFRepo) refresh(ctx context.Context) error {
+	previousRoot, err := t.updateRoot(func(name string) ([]byte, error) {
+		return t.fetch(ctx, name, maxMetadataSize)
+	})
+	if err != nil {
+		return err
+	}
+	if err := t.root.checkExpiry(roleRoot, t.now()); err != nil {
+		return err
+	}
+	// After a key rotation we can't trust the old versions anymore, otherwise the rotation couldn't recover
+	// from a fast-forward attack
+	if !previousRoot.sameKeys(t.root, roleTimestamp) || !previousRoot.sameKeys(t.root, roleSnapshot) {
+		t.timestamp, t.snapshot = nil, nil
+	}
+	if !previousRoot.sameKeys(t.root, roleTargets) {
+		t.targets = nil
+	}
+
+	if err := t.updateTimestamp(ctx); err != nil {
+		return err
+	}
+	if err := t.updateSnapshot(ctx); err != nil {
+		return err
+	}
+	return t.updateTargets(ctx)
+}
+
+// updateRoot walks all newer root versions available via fetch. Every version needs to be signed by the
+// keys of its predecessor and its own keys. The root which was trusted before is returned.
+func (t *TUFRepo) updateRoot(fetch func(name string) ([]byte, error)) (*rootMetadata, error) {
+	previous := t.root
+	for i := 0; i < maxRootRotations; i++ {
+		name := fmt.Sprintf("%d.root.json", t.root.Version+1)
+		data, err := fetch(name)
+		if errors.Is(err, errNotFound) || errors.Is(err, os.ErrNotExist) {
+			return previous, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", name, err)
+		}
+		root := &rootMetadata{}
+		env, err := parse(data, roleRoot, root)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.root.verify(env, roleRoot); err != nil {
+			return nil, fmt.Errorf("%s is not signed by the trusted root: %w", name, err)
+		}
+		if err := root.verify(env, roleRoot); err != nil {
+			return nil, fmt.Errorf("%s is not signed by its own keys: %w", name, err)
+		}
+		if root.Version != t.root.Version+1 {
+			return nil, fmt.Errorf("%w: %s has version %d", ErrVersionMismatch, name, root.Version)
+		}
+		if err := t.storeState(name, data); err != nil {
+			return nil, err
+		}
+		t.root = root
+	}
+	return previous, nil
+}
+
+func (t *TUFRepo) updateTimestamp(ctx context.Context) error {
+	data, err := t.fetch(ctx, timestampFile, maxMetadataSize)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", timestampFile, err)
+	}
+	timestamp := &timestampMetadata{}
+	env, err := parse(data, roleTimestamp, timestamp)
+	if err != nil {
+		return err
+	}
+	if err := t.root.verify(env, roleTimestamp); err != nil {
+		return err
+	}
+	if _, exists := timestamp.Meta[snapshotFile]; !exists {
+		return fmt.Errorf("timestamp metadata doesn't list %s", snapshotFile)
+	}
+	if t.timestamp != nil {
+		if timestamp.Version < t.timestamp.Version {
+			return fmt.Errorf("%w: timestamp version %d < %d", ErrRollback, timestamp.Version, t.timestamp.Version)
+		}
+		if timestamp.Meta[snapshotFile].Version < t.timestamp.Meta[snapshotFile].Version {
+			return fmt.Errorf("%w: snapshot version %d < %d", ErrRollback,
+				timestamp.Meta[snapshotFile].Version, t.timestamp.Meta[snapshotFile].Version)
+		}
+	}
+	if err := timestamp.checkExpiry(roleTimestamp, t.now()); err != nil {
+		return err
+	}
+	if err := t.storeState(timestampFile, data); err != nil {
+		return err
+	}
+	t.timestamp = timestamp
+	return nil
+}
+
+func (t *TUFRepo) updateSnapshot(ctx context.Context) error {
+	expected := t.timestamp.Meta[snapshotFile]
+	data, err := t.fetchMeta(ctx, snapshotFile, expected)
+	if err != nil {
+		return err
+	}
+	snapshot := &snapshotMetadata{}
+	env, err := parse(data, roleSnapshot, snapshot)
+	if err != nil {
+		return err
+	}
+	if err := t.root.verify(env, roleSnapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != expected.Version {
+		return fmt.Errorf("%w: snapshot version %d, timestamp lists %d", ErrVersionMismatch, snapshot.Version, expected.Version)
+	}
+	if t.snapshot != nil {
+		for name, trusted := range t.snapshot.Meta {
+			current, exists := snapshot.Meta[name]
+			if !exists {
+				return fmt.Errorf("%w: %s was removed from the snapshot", ErrRollback, name)
+			}
+			if current.Version < trusted.Version {
+				return fmt.Errorf("%w: %s version %d < %d", ErrRollback, name, current.Version, trusted.Version)
+			}
+		}
+	}
+	if err := snapshot.checkExpiry(roleSnapshot, t.now()); err != nil {
+		return err
+	}
+	if err := t.storeState(snapshotFile, data); err != nil {
+		return err
+	}
+	t.snapshot = snapshot
+	return nil
+}
+
+func (t *TUFRepo) updateTargets(ctx context.Context) error {
+	expected, exists := t.snapshot.Meta[targetsFile]
+	if !exists {
+		return fmt.Errorf("snapshot metadata doesn't list %s", targetsFile)
+	}
+	data, err := t.fetchMeta(ctx, targetsFile, expected)
+	if err != nil {
+		return err
+	}
+	targets := &targetsMetadata{}
+	env, err := parse(data, roleTargets, targets)
+	if err != nil {
+		return err
+	}
+	if err := t.root.verify(env, roleTargets); err != nil {
+		return err
+	}
+	if targets.Version != expected.Version {
+		return fmt.Errorf("%w: targets version %d, snapshot lists %d", ErrVersionMismatch, targets.Version, expected.Version)
+	}
+	if err := targets.checkExpiry(roleTargets, t.now()); err != nil {
+		return err
+	}
+	if err := t.storeState(targetsFile, data); err != nil {
+		return err
+	}
+	t.targets = targets
+	return nil
+}
+
+// fetchMeta loads a metadata file listed by its parent role and checks its length and hashes
+func (t *TUFRepo) fetchMeta(ctx context.Context, name string, expected metaFile) ([]byte, error) {
+	remoteName := name
+	if t.root.ConsistentSnapshot {
+		remoteName = fmt.Sprintf("%d.%s", expected.Version, name)
+	}
+	limit := int64(maxMetadataSize)
+	if expected.Length > 0 {
+		limit = expected.Length
+	}
+	data, err := t.fetch(ctx, remoteName, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", remoteName, err)
+	}
+	if expected.Length > 0 && int64(len(data)) != expected.Length {
+		return nil, fmt.Errorf("%w: %s has length %d, expected %d", ErrHashMismatch, name, len(data), expected.Length)
+	}
+	if err := verifyHashes(data, expected.Hashes); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return data, nil
+}
+
+func verifyHashes(data []byte, hashes map[string]string) error {
+	for algorithm, expected := range hashes {
+		var h hash.Hash
+		switch algorithm {
+		case "sha256":
+			h = sha256.New()
+		case "sha512":
+			h = sha512.New()
+		default:
+			continue
+		}
+		h.Write(data)
+		if hex.EncodeToString(h.Sum(nil)) != strings.ToLower(expected) {
+			return fmt.Errorf("%w: %s", ErrHashMismatch, algorithm)
+		}
+	}
+	return nil
+}
+
+func (t *TUFRepo) fetch(ctx context.Context, name string, limit int64) ([]byte, error) {
+	u, err := t.metadataURL.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
+		// Object storages often answer with forbidden if the object doesn't exist
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s exceeds the maximum size of %d bytes", name, limit)
+	}
+	return data, nil
+}
+
+func (t *TUFRepo) loadState(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(t.stateDir, name))
+}
+
+// storeState writes the metadata atomically, so a power loss can't leave broken metadata behind
+func (t *TUFRepo) storeState(name string, data []byte) error {
+	tmpFile, err := os.CreateTemp(t.stateDir, name+".*")
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %w", name, err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to store %s: %w", name, err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to store %s: %w", name, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to store %s: %w", name, err)
+	}
+	return os.Rename(tmpFile.Name(), filepath.Join(t.stateDir, name))
+}
+
+// verifiedUpdates removes all bundles which are not listed in the targets metadata and attaches the hash
+// of the bundles. The version and flags of the release are taken from the custom data of its targets, updates
+// without any verified bundle are removed.
+func (t *TUFRepo) verifiedUpdates(updates []repository.Update) (verified []repository.Update) {
+	for _, update := range updates {
+		logger := t.logger.WithField("version", update.Version.String())
+		var bundles []*repository.BundleLink
+		var release *targetCustom
+		signed := update
+		for _, bundle := range update.Bundles {
+			target, err := t.target(bundle)
+			if err == nil && release != nil && !reflect.DeepEqual(release, target.Custom) {
+				err = fmt.Errorf("%w: bundles of the release are signed with different release metadata", ErrTargetMismatch)
+			} else if err == nil && release == nil {
+				candidate := update
+				if err = target.Custom.apply(&candidate); err == nil {
+					signed = candidate
+				}
+			}
+			if err != nil {
+				logger.WithError(err).WithField("bundleURL", bundle.URL).Warn("skipping unverified bundle")
+				continue
+			}
+			release = target.Custom
+			verifiedBundle := *bundle
+			verifiedBundle.SHA256 = target.Hashes["sha256"]
+			verifiedBundle.Size = target.Length
+			bundles = append(bundles, &verifiedBundle)
+		}
+		if len(bundles) == 0 {
+			logger.Warn("skipping update without verified bundles")
+			continue
+		}
+		signed.Bundles = bundles
+		signed.Verified = true
+		verified = append(verified, signed)
+	}
+	return
+}
+
+// target looks up the bundle in the targets metadata. Target paths can contain directories, so the
+// asset name is compared to the file name of the target path.
+func (t *TUFRepo) target(bundle *repository.BundleLink) (*targetFile, error) {
+	assetName := bundle.AssetName
+	if assetName == "" {
+		if u, err := url.Parse(bundle.URL); err == nil {
+			_, assetName = path.Split(u.Path)
+		}
+	}
+	var match *targetFile
+	for targetPath, target := range t.targets.Targets {
+		if targetPath != assetName && path.Base(targetPath) != assetName {
+			continue
+		}
+		if match != nil {
+			return nil, fmt.Errorf("bundle %s matches several targets", assetName)
+		}
+		target := target
+		match = &target
+	}
+	if match == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTargetFile, assetName)
+	}
+	if match.Hashes["sha256"] == "" {
+		return nil, fmt.Errorf("target %s has no sha256 hash", assetName)
+	}
+	if bundle.Size > 0 && bundle.Size != match.Length {
+		return nil, fmt.Errorf("%w: bundle %s has size %d, targets metadata lists %d", ErrHashMismatch,
+			assetName, bundle.Size, match.Length)
+	}
+	return match, nil
+}
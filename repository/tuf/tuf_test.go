@@ -0,0 +1,315 @@
+package tuf
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/mocks"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const bundleName = "cbpifw-raspberrypi3-64_v1.8.2_update.bin"
+
+var bundleHash = strings.Repeat("ab", 32)
+
+type testKey struct {
+	id      string
+	public  key
+	private ed25519.PrivateKey
+}
+
+func newTestKey(t *testing.T) *testKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	k := key{KeyType: keyTypeEd25519, Scheme: keyTypeEd25519}
+	k.KeyVal.Public = hex.EncodeToString(public)
+	data, err := json.Marshal(k)
+	require.NoError(t, err)
+	canonical, err := canonicalJSON(data)
+	require.NoError(t, err)
+	id := sha256.Sum256(canonical)
+	return &testKey{id: hex.EncodeToString(id[:]), public: k, private: private}
+}
+
+// testServer serves signed metadata and allows to modify it between requests
+type testServer struct {
+	t     *testing.T
+	srv   *httptest.Server
+	lock  sync.Mutex
+	files map[string][]byte
+	keys  map[string]*testKey
+	root  rootMetadata
+	// release is signed as custom data of the bundle target
+	release targetCustom
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{t: t, files: make(map[string][]byte), keys: make(map[string]*testKey)}
+	s.release = targetCustom{Version: "1.8.2"}
+	s.root = rootMetadata{
+		common: common{Type: roleRoot, SpecVersion: "1.0.31", Version: 1, Expires: time.Now().Add(365 * 24 * time.Hour)},
+		Keys:   make(map[string]key),
+		Roles:  make(map[string]role),
+	}
+	for _, roleName := range []string{roleRoot, roleTimestamp, roleSnapshot, roleTargets} {
+		s.setKey(roleName, newTestKey(t))
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		data, exists := s.files[strings.TrimPrefix(r.URL.Path, "/metadata/")]
+		s.lock.Unlock()
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+func (s *testServer) setKey(roleName string, k *testKey) {
+	s.keys[roleName] = k
+	s.root.Keys[k.id] = k.public
+	s.root.Roles[roleName] = role{KeyIDs: []string{k.id}, Threshold: 1}
+}
+
+func (s *testServer) sign(signed interface{}, keys ...*testKey) []byte {
+	payload, err := json.Marshal(signed)
+	require.NoError(s.t, err)
+	canonical, err := canonicalJSON(payload)
+	require.NoError(s.t, err)
+	env := envelope{Signed: payload}
+	for _, k := range keys {
+		env.Signatures = append(env.Signatures, signature{
+			KeyID:     k.id,
+			Signature: hex.EncodeToString(ed25519.Sign(k.private, canonical)),
+		})
+	}
+	data, err := json.Marshal(env)
+	require.NoError(s.t, err)
+	return data
+}
+
+// publish signs and serves a complete set of metadata with the given versions
+func (s *testServer) publish(timestampVersion, snapshotVersion, targetsVersion int64, expires time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	targets := targetsMetadata{
+		common: common{Type: roleTargets, Version: targetsVersion, Expires: expires},
+		Targets: map[string]targetFile{
+			"v1.8.2/" + bundleName: {Length: 1024, Hashes: map[string]string{"sha256": bundleHash}, Custom: &s.release},
+		},
+	}
+	s.files[targetsFile] = s.sign(targets, s.keys[roleTargets])
+	snapshot := snapshotMetadata{
+		common: common{Type: roleSnapshot, Version: snapshotVersion, Expires: expires},
+		Meta:   map[string]metaFile{targetsFile: {Version: targetsVersion}},
+	}
+	s.files[snapshotFile] = s.sign(snapshot, s.keys[roleSnapshot])
+	sum := sha256.Sum256(s.files[snapshotFile])
+	timestamp := timestampMetadata{
+		common: common{Type: roleTimestamp, Version: timestampVersion, Expires: expires},
+		Meta: map[string]metaFile{snapshotFile: {
+			Version: snapshotVersion,
+			Length:  int64(len(s.files[snapshotFile])),
+			Hashes:  map[string]string{"sha256": hex.EncodeToString(sum[:])},
+		}},
+	}
+	s.files[timestampFile] = s.sign(timestamp, s.keys[roleTimestamp])
+}
+
+func (s *testServer) rootFile() []byte {
+	return s.sign(s.root, s.keys[roleRoot])
+}
+
+func newTestRepo(t *testing.T, s *testServer, stateDir string) *TUFRepo {
+	return newTestRepoWithUpdates(t, s, stateDir, []repository.Update{
+		{
+			Version: semver.New("1.8.2"),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/" + bundleName, AssetName: bundleName},
+				{URL: "https://example.com/cbpifw-raspberrypi4-64_v1.8.2_update.bin", AssetName: "cbpifw-raspberrypi4-64_v1.8.2_update.bin"},
+			},
+		},
+		{
+			Version: semver.New("1.9.0"),
+			Bundles: []*repository.BundleLink{
+				{URL: "https://example.com/cbpifw-raspberrypi3-64_v1.9.0_update.bin", AssetName: "cbpifw-raspberrypi3-64_v1.9.0_update.bin"},
+			},
+		},
+	})
+}
+
+func newTestRepoWithUpdates(t *testing.T, s *testServer, stateDir string, updates []repository.Update) *TUFRepo {
+	trustedRoot := filepath.Join(t.TempDir(), "root.json")
+	require.NoError(t, os.WriteFile(trustedRoot, s.rootFile(), 0600))
+
+	inner := mocks.NewRepository(t)
+	inner.EXPECT().Updates(mock.Anything).Maybe().Return(updates, nil)
+	repo, err := New(inner, Config{MetadataURL: s.srv.URL + "/metadata", TrustedRoot: trustedRoot, StateDir: stateDir})
+	require.NoError(t, err)
+	return repo
+}
+
+func TestVerifiedUpdates(t *testing.T) {
+	s := newTestServer(t)
+	s.publish(1, 1, 1, time.Now().Add(time.Hour))
+	repo := newTestRepo(t, s, t.TempDir())
+
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, "1.8.2", updates[0].Version.String())
+	require.Len(t, updates[0].Bundles, 1)
+	assert.Equal(t, bundleName, updates[0].Bundles[0].AssetName)
+	assert.Equal(t, bundleHash, updates[0].Bundles[0].SHA256)
+	assert.Equal(t, int64(1024), updates[0].Bundles[0].Size)
+	// Signature verification of checksum files must not replace the hashes of the targets metadata
+	assert.True(t, updates[0].Verified)
+}
+
+func TestReleaseMetadataIsSigned(t *testing.T) {
+	s := newTestServer(t)
+	percentage := 20
+	s.release = targetCustom{Version: "v1.8.2", Mandatory: true, RolloutPercentage: &percentage}
+	s.publish(1, 1, 1, time.Now().Add(time.Hour))
+	repo := newTestRepoWithUpdates(t, s, t.TempDir(), []repository.Update{
+		{
+			Version:        semver.New("1.8.2"),
+			MinimumVersion: semver.New("1.8.0"),
+			Channel:        "stable",
+			Bundles:        []*repository.BundleLink{{URL: "https://example.com/" + bundleName}},
+		},
+	})
+
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.True(t, updates[0].Mandatory)
+	assert.Nil(t, updates[0].MinimumVersion)
+	assert.Empty(t, updates[0].Channel)
+	assert.Equal(t, &percentage, updates[0].RolloutPercentage)
+}
+
+func TestTargetOfOtherVersionIsRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.publish(1, 1, 1, time.Now().Add(time.Hour))
+	// An old bundle which is still listed in the targets is published as a new release
+	repo := newTestRepoWithUpdates(t, s, t.TempDir(), []repository.Update{
+		{
+			Version: semver.New("9.0.0"),
+			Bundles: []*repository.BundleLink{{URL: "https://example.com/" + bundleName}},
+		},
+	})
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+
+	// Targets without a signed version are refused as well
+	s.release = targetCustom{}
+	s.publish(2, 2, 2, time.Now().Add(time.Hour))
+	repo = newTestRepo(t, s, t.TempDir())
+	updates, err = repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+}
+
+func TestRollbackIsRejected(t *testing.T) {
+	s := newTestServer(t)
+	stateDir := t.TempDir()
+	s.publish(5, 5, 5, time.Now().Add(time.Hour))
+	repo := newTestRepo(t, s, stateDir)
+	_, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+
+	s.publish(4, 4, 4, time.Now().Add(time.Hour))
+	_, err = repo.Updates(context.Background())
+	assert.ErrorIs(t, err, ErrRollback)
+
+	// The trusted versions survive a restart
+	repo = newTestRepo(t, s, stateDir)
+	_, err = repo.Updates(context.Background())
+	assert.ErrorIs(t, err, ErrRollback)
+}
+
+func TestExpiredMetadataIsRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.publish(1, 1, 1, time.Now().Add(-time.Minute))
+	repo := newTestRepo(t, s, t.TempDir())
+	_, err := repo.Updates(context.Background())
+	assert.ErrorIs(t, err, ErrExpired)
+	// A cache in front of TUF must not fall back to older metadata
+	assert.True(t, repository.IsUntrusted(err))
+}
+
+func TestMixAndMatchIsRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.publish(2, 2, 2, time.Now().Add(time.Hour))
+	targets := s.files[targetsFile]
+	s.publish(3, 3, 3, time.Now().Add(time.Hour))
+	s.files[targetsFile] = targets
+	repo := newTestRepo(t, s, t.TempDir())
+	_, err := repo.Updates(context.Background())
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+}
+
+func TestInvalidSignatureIsRejected(t *testing.T) {
+	s := newTestServer(t)
+	s.publish(1, 1, 1, time.Now().Add(time.Hour))
+	s.files[timestampFile] = s.sign(timestampMetadata{
+		common: common{Type: roleTimestamp, Version: 2, Expires: time.Now().Add(time.Hour)},
+		Meta:   map[string]metaFile{snapshotFile: {Version: 1}},
+	}, newTestKey(t))
+	repo := newTestRepo(t, s, t.TempDir())
+	_, err := repo.Updates(context.Background())
+	assert.ErrorIs(t, err, ErrThreshold)
+}
+
+func TestRootRotation(t *testing.T) {
+	s := newTestServer(t)
+	stateDir := t.TempDir()
+	s.publish(1, 1, 1, time.Now().Add(time.Hour))
+	repo := newTestRepo(t, s, stateDir)
+	_, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+
+	oldRootKey := s.keys[roleRoot]
+	s.setKey(roleRoot, newTestKey(t))
+	s.setKey(roleTimestamp, newTestKey(t))
+	s.root.Version = 2
+	s.files["2.root.json"] = s.sign(s.root, oldRootKey, s.keys[roleRoot])
+	// A new timestamp key resets the trusted timestamp, so the repository can recover from compromised keys
+	s.publish(1, 1, 1, time.Now().Add(time.Hour))
+
+	updates, err := repo.Updates(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, updates, 1)
+	assert.Equal(t, int64(2), repo.root.Version)
+	assert.FileExists(t, filepath.Join(stateDir, "2.root.json"))
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	canonical, err := canonicalJSON([]byte(`{"b": [1, "x\"y\\z"], "a": {"d": null, "c": true}}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":{"c":true,"d":null},"b":[1,"x\"y\\z"]}`, string(canonical))
+
+	_, err = canonicalJSON([]byte(`{"a": 1.5}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// Wrapper passes the optional interfaces like Watcher or InstallReporter through to a wrapped repository.
+// Repositories wrapping another one embed it, so the manager still reaches the repository the updates
+// originate from.
+type Wrapper struct {
+	route func(update *Update) Repository
+}
+
+// Wrap passes all calls through to repo
+func Wrap(repo Repository) Wrapper {
+	return Wrapper{route: func(*Update) Repository { return repo }}
+}
+
+// WrapRouted passes calls concerning an update through to the repository returned by route, i.e. the repository
+// it originates from. route is called with nil for calls which don't concern a single update.
+func WrapRouted(route func(update *Update) Repository) Wrapper {
+	return Wrapper{route: route}
+}
+
+// Watch passes through to the wrapped repository if it supports watching
+func (w Wrapper) Watch(ctx context.Context, changed func()) error {
+	if watcher, ok := w.route(nil).(Watcher); ok {
+		return watcher.Watch(ctx, changed)
+	}
+	return nil
+}
+
+// RepositoryStatus passes through to the wrapped repository if it reports its status
+func (w Wrapper) RepositoryStatus() map[string]string {
+	if reporter, ok := w.route(nil).(StatusReporter); ok {
+		return reporter.RepositoryStatus()
+	}
+	return nil
+}
+
+// BootedVersion passes through to the wrapped repository if it waits for the device to boot an update
+func (w Wrapper) BootedVersion(ctx context.Context, version *semver.Version) error {
+	if reporter, ok := w.route(nil).(BootReporter); ok {
+		return reporter.BootedVersion(ctx, version)
+	}
+	return nil
+}
+
+func (w Wrapper) InstallStarted(ctx context.Context, update *Update) error {
+	if reporter, ok := w.route(update).(InstallReporter); ok {
+		return reporter.InstallStarted(ctx, update)
+	}
+	return nil
+}
+
+func (w Wrapper) InstallProgress(ctx context.Context, update *Update, percentage int32) error {
+	if reporter, ok := w.route(update).(InstallReporter); ok {
+		return reporter.InstallProgress(ctx, update, percentage)
+	}
+	return nil
+}
+
+func (w Wrapper) InstallFinished(ctx context.Context, update *Update, err error) error {
+	if reporter, ok := w.route(update).(InstallReporter); ok {
+		return reporter.InstallFinished(ctx, update, err)
+	}
+	return nil
+}
+
+func (w Wrapper) UpdateRejected(ctx context.Context, update *Update, reason error) error {
+	if rejecter, ok := w.route(update).(UpdateRejecter); ok {
+		return rejecter.UpdateRejected(ctx, update, reason)
+	}
+	return nil
+}
+
+func (w Wrapper) BundleHeader(ctx context.Context, update *Update, bundle *BundleLink) (http.Header, error) {
+	if authorizer, ok := w.route(update).(BundleAuthorizer); ok {
+		return authorizer.BundleHeader(ctx, update, bundle)
+	}
+	return nil, nil
+}
@@ -0,0 +1,60 @@
+package raucgithub
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+)
+
+// DefaultDeviceIDFile identifies the device for staged rollouts unless configured otherwise
+const DefaultDeviceIDFile = "/etc/machine-id"
+
+// WithDeviceID sets the stable identifier of the device, which decides whether the device is part of a staged
+// rollout. Devices without an identifier only receive updates which are meant for all devices.
+func WithDeviceID(deviceID string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.deviceID = deviceID
+		return u
+	}
+}
+
+// ReadDeviceID reads a device identifier like the machine-id or a serial number from a file
+func ReadDeviceID(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read device id: %w", err)
+	}
+	// Serial numbers from the device tree are terminated by a null byte
+	deviceID := strings.TrimSpace(strings.Trim(string(data), "\x00"))
+	if deviceID == "" {
+		return "", fmt.Errorf("device id in %s is empty", file)
+	}
+	return deviceID, nil
+}
+
+// rolloutBucket maps the device to one of 100 buckets. The version is part of the hash, so the same devices
+// don't always receive new releases first.
+func rolloutBucket(deviceID string, version *semver.Version) int {
+	sum := sha256.Sum256([]byte(deviceID + "/" + version.String()))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
+// inRollout reports whether the device belongs to the share of devices which currently receive the update.
+// A device stays selected while the percentage grows.
+func (u *UpdateManager) inRollout(percentage int, version *semver.Version) (bool, error) {
+	if percentage >= 100 {
+		return true, nil
+	}
+	if percentage <= 0 {
+		return false, nil
+	}
+	if u.deviceID == "" {
+		return false, errors.New("device id is unknown, staged rollouts are only installed when they reach 100%")
+	}
+	return rolloutBucket(u.deviceID, version) < percentage, nil
+}
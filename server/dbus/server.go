@@ -6,6 +6,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dereulenspiegel/raucgithub"
@@ -30,9 +32,37 @@ const intro = `
 		<method name="Progress">
 			<arg direction="out" type="i"/>
 		</method>
+		<method name="Channel">
+			<arg direction="out" type="s"/>
+		</method>
+		<method name="Channels">
+			<arg direction="out" type="as"/>
+		</method>
+		<method name="SetChannel">
+			<arg name="channel" direction="in" type="s"/>
+		</method>
+		<method name="VersionConstraint">
+			<arg direction="out" type="s"/>
+		</method>
+		<method name="SetVersionConstraint">
+			<arg name="constraint" direction="in" type="s"/>
+		</method>
+		<method name="PinVersion">
+			<arg name="version" direction="in" type="s"/>
+		</method>
+		<method name="RepositoryStatus">
+			<arg direction="out" type="a{ss}"/>
+		</method>
 		<signal name="UpdateAvailable">
 			<arg name="update" type="a{ss}"/>
 		</signal>
+		<signal name="BootedVersionYanked">
+			<arg name="update" type="a{ss}"/>
+		</signal>
+		<signal name="VerificationFailed">
+			<arg name="update" type="a{ss}"/>
+			<arg name="error" type="s"/>
+		</signal>
 		<property name="AvailableUpdate" type="a{ss}" access="read"/>
 	</interface>` + introspect.IntrospectDataString + `</node> `
 
@@ -102,6 +132,8 @@ func (s *Server) Start(ctx context.Context) (err error) {
 	}
 
 	s.manager.RegisterUpdateAvailableCallback(s.updateAvailable)
+	s.manager.RegisterVerificationFailedCallback(s.verificationFailed)
+	s.manager.RegisterBootedVersionYankedCallback(s.bootedVersionYanked)
 	return nil
 }
 
@@ -111,18 +143,49 @@ func (s *Server) Close() error {
 }
 
 func (s *Server) updateAvailable(update *repository.Update) {
-	if err := s.conn.Emit("/com/github/dereulenspiegel/rauc", "com.github.dereulenspiegel.rauc.UpdateAvailable", mapFromUpdate(update)); err != nil {
+	if err := s.conn.Emit("/com/github/dereulenspiegel/rauc", "com.github.dereulenspiegel.rauc.UpdateAvailable", s.mapFromUpdate(update)); err != nil {
 		s.logger.WithError(err).Error("failed to emit DBus signal on new update")
 	}
 }
 
-func mapFromUpdate(update *repository.Update) map[string]string {
-	return map[string]string{
+func (s *Server) verificationFailed(update *repository.Update, err error) {
+	updateMap := map[string]string{}
+	if update != nil {
+		updateMap = s.mapFromUpdate(update)
+	}
+	if err := s.conn.Emit("/com/github/dereulenspiegel/rauc", "com.github.dereulenspiegel.rauc.VerificationFailed", updateMap, err.Error()); err != nil {
+		s.logger.WithError(err).Error("failed to emit DBus signal on failed verification")
+	}
+}
+
+func (s *Server) bootedVersionYanked(update *repository.Update) {
+	if err := s.conn.Emit("/com/github/dereulenspiegel/rauc", "com.github.dereulenspiegel.rauc.BootedVersionYanked", s.mapFromUpdate(update)); err != nil {
+		s.logger.WithError(err).Error("failed to emit DBus signal on yanked booted version")
+	}
+}
+
+func (s *Server) mapFromUpdate(update *repository.Update) map[string]string {
+	m := map[string]string{
 		"name":        update.Name,
 		"notes":       update.Notes,
+		"summary":     update.Summary,
 		"version":     update.Version.String(),
 		"releaseDate": update.ReleaseDate.Format(time.RFC3339),
+		"critical":    strconv.FormatBool(update.Critical),
+		"mandatory":   strconv.FormatBool(update.Mandatory),
+		"channel":     s.manager.ChannelOf(update),
+	}
+	if update.MinimumVersion != nil {
+		m["minimumVersion"] = update.MinimumVersion.String()
+	}
+	if update.Yanked {
+		m["yanked"] = "true"
+		m["yankReason"] = update.YankReason
 	}
+	if update.RolloutPercentage != nil || len(update.RolloutSchedule) > 0 {
+		m["rolloutPercentage"] = strconv.Itoa(repository.RolloutPercentageAt(update, time.Now()))
+	}
+	return m
 }
 
 func (s *Server) NextUpdate() (map[string]string, *dbus.Error) {
@@ -131,7 +194,15 @@ func (s *Server) NextUpdate() (map[string]string, *dbus.Error) {
 		return nil, dbus.MakeFailedError(err)
 	}
 
-	return mapFromUpdate(update), nil
+	m := s.mapFromUpdate(update)
+	if path := s.manager.UpgradePath(); len(path) > 1 {
+		versions := make([]string, len(path))
+		for i, version := range path {
+			versions[i] = version.String()
+		}
+		m["upgradePath"] = strings.Join(versions, ",")
+	}
+	return m, nil
 }
 
 func (s *Server) InstallNextUpdateAsync() *dbus.Error {
@@ -160,3 +231,40 @@ func (s *Server) Progress() (int32, *dbus.Error) {
 	}
 	return progress, nil
 }
+
+func (s *Server) Channel() (string, *dbus.Error) {
+	return s.manager.Channel(), nil
+}
+
+func (s *Server) Channels() ([]string, *dbus.Error) {
+	return s.manager.Channels(), nil
+}
+
+func (s *Server) SetChannel(channel string) *dbus.Error {
+	if err := s.manager.SetChannel(channel); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *Server) VersionConstraint() (string, *dbus.Error) {
+	return s.manager.VersionConstraint(), nil
+}
+
+func (s *Server) SetVersionConstraint(constraint string) *dbus.Error {
+	if err := s.manager.SetVersionConstraint(constraint); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *Server) PinVersion(version string) *dbus.Error {
+	if err := s.manager.PinVersion(version); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (s *Server) RepositoryStatus() (map[string]string, *dbus.Error) {
+	return s.manager.RepositoryStatus(), nil
+}
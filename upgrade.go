@@ -0,0 +1,42 @@
+package raucgithub
+
+import (
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/repository"
+)
+
+// reachableUpdates returns the updates which can be installed directly on top of current, newest first.
+// updates need to be newer than current and sorted by version. Devices may skip releases, but not mandatory
+// ones, so everything newer than the first mandatory update is out of reach. Updates which require a newer
+// installed version than current are out of reach as well.
+func reachableUpdates(current *semver.Version, updates []repository.Update) (reachable []repository.Update) {
+	for _, update := range updates {
+		if update.MinimumVersion == nil || !current.LessThan(*update.MinimumVersion) {
+			reachable = append([]repository.Update{update}, reachable...)
+		}
+		if update.Mandatory {
+			break
+		}
+	}
+	return reachable
+}
+
+// upgradePath returns the versions which are installed one after another to get from current to the newest of
+// updates, which need to be newer than current and sorted by version. The path ends early if the remaining
+// updates can't be reached.
+func upgradePath(current *semver.Version, updates []repository.Update) (path []*semver.Version) {
+	for {
+		var remaining []repository.Update
+		for _, update := range updates {
+			if current.LessThan(*update.Version) {
+				remaining = append(remaining, update)
+			}
+		}
+		reachable := reachableUpdates(current, remaining)
+		if len(reachable) == 0 {
+			return path
+		}
+		current = reachable[0].Version
+		path = append(path, current)
+	}
+}
@@ -0,0 +1,23 @@
+package raucgithub
+
+import (
+	"github.com/dereulenspiegel/raucgithub/repository"
+)
+
+// VerifySignatures only offers updates whose checksum file carries a valid detached signature, unless the
+// repository verified the metadata of the update itself. The bundles are verified against the signed checksums
+// before they are installed.
+func VerifySignatures(verifier repository.SignatureVerifier) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.verifier = verifier
+		u.requireChecksums = true
+		u.verifyChecksums = true
+		return u
+	}
+}
+
+func (u *UpdateManager) verificationFailed(update *repository.Update, err error) {
+	for _, cb := range u.verificationFailedCallbacks {
+		go cb(update, err)
+	}
+}
@@ -0,0 +1,140 @@
+package raucgithub
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-semver/semver"
+	"github.com/dereulenspiegel/raucgithub/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// BootedVersionYankedCallback is called if the booted version has been withdrawn. The reason is stored in the
+// YankReason of the update.
+type BootedVersionYankedCallback func(*repository.Update)
+
+type blockedVersions struct {
+	constraint *VersionConstraint
+	reason     string
+}
+
+// BlockVersions never offers versions matching one of the constraints, in addition to the releases which
+// have been yanked in the repository
+func BlockVersions(constraints ...*VersionConstraint) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		for _, constraint := range constraints {
+			u.blocklist = append(u.blocklist, blockedVersions{constraint: constraint, reason: "blocklisted"})
+		}
+		return u
+	}
+}
+
+// ReadBlocklistFrom never offers versions listed in file. The file is read before each check, so versions can
+// be blocked without restarting. Each line contains a version or a version constraint, optionally followed by
+// a comment with the reason, i.e. "1.8.1 # breaks the temperature sensor".
+func ReadBlocklistFrom(file string) UpdateManagerOption {
+	return func(u *UpdateManager) *UpdateManager {
+		u.blocklistFile = file
+		return u
+	}
+}
+
+// parseBlocklist parses the content of a blocklist file. Invalid lines are skipped, so a typo doesn't unblock
+// the other versions.
+func parseBlocklist(data []byte, logger logrus.FieldLogger) (blocklist []blockedVersions, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line, reason, _ := strings.Cut(scanner.Text(), "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		constraint, err := ParseVersionConstraint(line)
+		if err != nil {
+			logger.WithError(err).WithField("line", lineNumber).Warn("skipping invalid blocklist entry")
+			continue
+		}
+		reason = strings.TrimSpace(reason)
+		if reason == "" {
+			reason = "blocklisted"
+		}
+		blocklist = append(blocklist, blockedVersions{constraint: constraint, reason: reason})
+	}
+	return blocklist, scanner.Err()
+}
+
+func (u *UpdateManager) currentBlocklist(logger logrus.FieldLogger) []blockedVersions {
+	blocklist := u.blocklist
+	if u.blocklistFile == "" {
+		return blocklist
+	}
+	logger = logger.WithField("blocklist", u.blocklistFile)
+	data, err := os.ReadFile(u.blocklistFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return blocklist
+	} else if err != nil {
+		logger.WithError(err).Error("failed to read blocklist")
+		return blocklist
+	}
+	fromFile, err := parseBlocklist(data, logger)
+	if err != nil {
+		// Entries which have been read before the error are still blocked
+		logger.WithError(err).Error("failed to parse blocklist")
+	}
+	return append(append([]blockedVersions{}, blocklist...), fromFile...)
+}
+
+// yanked reports whether the version has been withdrawn in the repository or is blocked locally
+func yanked(update *repository.Update, blocklist []blockedVersions) (reason string, isYanked bool) {
+	if update.Yanked {
+		return update.YankReason, true
+	}
+	for _, blocked := range blocklist {
+		if blocked.constraint.Check(update.Version) {
+			return blocked.reason, true
+		}
+	}
+	return "", false
+}
+
+// checkBootedVersion warns if the booted version has been yanked
+func (u *UpdateManager) checkBootedVersion(version *semver.Version, updates []repository.Update, blocklist []blockedVersions,
+	logger logrus.FieldLogger) {
+	booted := &repository.Update{Version: version}
+	for _, update := range updates {
+		if update.Version.Equal(*version) {
+			update := update
+			booted = &update
+			break
+		}
+	}
+	reason, isYanked := yanked(booted, blocklist)
+	if !isYanked {
+		return
+	}
+	booted.Yanked, booted.YankReason = true, reason
+	logger.WithField("yankReason", reason).Warn("the booted version has been yanked and should be replaced")
+	for _, cb := range u.yankedCallbacks {
+		go cb(booted)
+	}
+}
+
+func (u *UpdateManager) RegisterBootedVersionYankedCallback(cb BootedVersionYankedCallback) {
+	u.yankedCallbacks = append(u.yankedCallbacks, cb)
+}
+
+func parseBlocklistConstraints(entries []string) (constraints []*VersionConstraint, err error) {
+	for _, entry := range entries {
+		constraint, err := ParseVersionConstraint(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocklist entry: %w", err)
+		}
+		constraints = append(constraints, constraint)
+	}
+	return constraints, nil
+}